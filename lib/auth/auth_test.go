@@ -18,11 +18,20 @@ package auth
 
 import (
 	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -362,6 +371,354 @@ func (s *AuthSuite) TestBadTokens(c *C) {
 	c.Assert(err, NotNil)
 }
 
+// TestTokenJWTFormat covers the TokenFormatJWT helpers generateTokenJWT,
+// validateJoinToken and IntrospectToken: generation, audience-scoped
+// validation (including signature tamper and nbf in the future) and
+// introspection of an expired-but-present JWT-format token.
+func (s *AuthSuite) TestTokenJWTFormat(c *C) {
+	signer, err := rsa.GenerateKey(rand.Reader, teleport.RSAKeySize)
+	c.Assert(err, IsNil)
+	c.Assert(s.a.Identity.UpsertJWTSigner(signer), IsNil)
+
+	tok, err := s.a.generateTokenJWT("node-token", teleport.Roles{teleport.RoleNode}, time.Hour, JoinAudienceNode)
+	c.Assert(err, IsNil)
+
+	// success: audience matches the join endpoint it's presented to
+	roles, err := s.a.validateJoinToken(tok, JoinAudienceNode)
+	c.Assert(err, IsNil)
+	c.Assert(roles.Include(teleport.RoleNode), Equals, true)
+
+	// audience mismatch: a node-join token replayed against proxy-join
+	_, err = s.a.validateJoinToken(tok, JoinAudienceProxy)
+	c.Assert(err, NotNil)
+
+	// signature tamper
+	parts := strings.Split(tok, ".")
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	c.Assert(err, IsNil)
+	sig[0] ^= 0xff
+	tampered := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sig)
+	_, err = s.a.validateJoinToken(tampered, JoinAudienceNode)
+	c.Assert(err, NotNil)
+
+	// nbf in the future: token is minted "ahead of time", then presented
+	// before that time arrives
+	s.a.SetClock(clockwork.NewFakeClockAt(time.Now().Add(time.Hour)))
+	futureTok, err := s.a.generateTokenJWT("future-token", teleport.Roles{teleport.RoleNode}, time.Hour, JoinAudienceNode)
+	c.Assert(err, IsNil)
+	s.a.SetClock(clockwork.NewFakeClockAt(time.Now()))
+	_, err = s.a.validateJoinToken(futureTok, JoinAudienceNode)
+	c.Assert(err, NotNil)
+	s.a.SetClock(clockwork.NewRealClock())
+
+	// introspection of an expired-but-present token
+	pastClock := clockwork.NewFakeClockAt(time.Now().Add(-2 * time.Hour))
+	s.a.SetClock(pastClock)
+	expiredTok, err := s.a.generateTokenJWT("expired-token", teleport.Roles{teleport.RoleNode}, time.Minute, JoinAudienceNode)
+	c.Assert(err, IsNil)
+	s.a.SetClock(clockwork.NewRealClock())
+
+	info, err := s.a.IntrospectToken(context.Background(), expiredTok)
+	c.Assert(err, IsNil)
+	c.Assert(info.Expired, Equals, true)
+	c.Assert(info.Name, Equals, "expired-token")
+	c.Assert(info.Audience, Equals, JoinAudienceNode)
+
+	_, err = s.a.validateJoinToken(expiredTok, JoinAudienceNode)
+	c.Assert(err, NotNil)
+}
+
+func (s *AuthSuite) TestRegisterUsingSSHPOP(c *C) {
+	ca := suite.NewTestCA(services.HostCA, "me.localhost")
+	c.Assert(s.a.UpsertCertAuthority(ca), IsNil)
+
+	signingKeys, err := ca.GetSigningKeys()
+	c.Assert(err, IsNil)
+	caSigner, err := ssh.ParsePrivateKey(signingKeys[0])
+	c.Assert(err, IsNil)
+
+	newHostCert := func(role teleport.Role, validBefore time.Time) (*ssh.Certificate, ssh.Signer) {
+		hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		c.Assert(err, IsNil)
+		hostSigner, err := ssh.NewSignerFromKey(hostKey)
+		c.Assert(err, IsNil)
+
+		cert := &ssh.Certificate{
+			Key:             hostSigner.PublicKey(),
+			CertType:        ssh.HostCert,
+			ValidPrincipals: []string{"host-1", "node-1"},
+			ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(validBefore.Unix()),
+			Permissions: ssh.Permissions{
+				Extensions: map[string]string{certExtensionTeleportRole: string(role)},
+			},
+		}
+		c.Assert(cert.SignCert(rand.Reader, caSigner), IsNil)
+		return cert, hostSigner
+	}
+
+	sign := func(signer ssh.Signer, hostID, nodeName string, role teleport.Role, ts time.Time) *ssh.Signature {
+		sig, err := signer.Sign(rand.Reader, sshPOPAssertion(hostID, nodeName, role, ts))
+		c.Assert(err, IsNil)
+		return sig
+	}
+
+	// success
+	cert, signer := newHostCert(teleport.RoleNode, time.Now().Add(time.Hour))
+	now := s.a.GetClock().Now()
+	keys, err := s.a.RegisterUsingSSHPOP(RegisterUsingSSHPOPRequest{
+		HostCert:  cert.Marshal(),
+		Timestamp: now,
+		Signature: sign(signer, "host-1", "node-1", teleport.RoleNode, now),
+		HostID:    "host-1",
+		NodeName:  "node-1",
+		Role:      teleport.RoleNode,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(keys, NotNil)
+
+	// wrong role: cert was issued for Node, request claims Proxy
+	_, err = s.a.RegisterUsingSSHPOP(RegisterUsingSSHPOPRequest{
+		HostCert:  cert.Marshal(),
+		Timestamp: now,
+		Signature: sign(signer, "host-1", "node-1", teleport.RoleProxy, now),
+		HostID:    "host-1",
+		NodeName:  "node-1",
+		Role:      teleport.RoleProxy,
+	})
+	c.Assert(err, NotNil)
+
+	// expired cert
+	expiredCert, expiredSigner := newHostCert(teleport.RoleNode, time.Now().Add(-time.Minute))
+	_, err = s.a.RegisterUsingSSHPOP(RegisterUsingSSHPOPRequest{
+		HostCert:  expiredCert.Marshal(),
+		Timestamp: now,
+		Signature: sign(expiredSigner, "host-1", "node-1", teleport.RoleNode, now),
+		HostID:    "host-1",
+		NodeName:  "node-1",
+		Role:      teleport.RoleNode,
+	})
+	c.Assert(err, NotNil)
+
+	// tampered signature
+	tamperedSig := sign(signer, "host-1", "node-1", teleport.RoleNode, now)
+	tamperedSig.Blob[0] ^= 0xff
+	_, err = s.a.RegisterUsingSSHPOP(RegisterUsingSSHPOPRequest{
+		HostCert:  cert.Marshal(),
+		Timestamp: now,
+		Signature: tamperedSig,
+		HostID:    "host-1",
+		NodeName:  "node-1",
+		Role:      teleport.RoleNode,
+	})
+	c.Assert(err, NotNil)
+
+	// revoked cert
+	c.Assert(s.a.RevokeHostCert(cert.Serial), IsNil)
+	_, err = s.a.RegisterUsingSSHPOP(RegisterUsingSSHPOPRequest{
+		HostCert:  cert.Marshal(),
+		Timestamp: now,
+		Signature: sign(signer, "host-1", "node-1", teleport.RoleNode, now),
+		HostID:    "host-1",
+		NodeName:  "node-1",
+		Role:      teleport.RoleNode,
+	})
+	c.Assert(err, NotNil)
+}
+
+func (s *AuthSuite) TestRegisterUsingKubernetesToken(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}},
+		})
+	}))
+	defer jwks.Close()
+
+	signJWT := func(claims map[string]interface{}) string {
+		header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+		c.Assert(err, IsNil)
+		payload, err := json.Marshal(claims)
+		c.Assert(err, IsNil)
+		signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		hash := sha256.Sum256([]byte(signingInput))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		c.Assert(err, IsNil)
+		return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	token, err := services.NewProvisionTokenV2("kube-token", time.Now().Add(time.Hour), services.ProvisionTokenSpecV2{
+		Roles:      teleport.Roles{teleport.RoleNode},
+		JoinMethod: services.JoinMethodKubernetes,
+		Kubernetes: &services.ProvisionTokenSpecV2Kubernetes{
+			Issuer:  "https://kubernetes.default.svc",
+			JWKSURI: jwks.URL,
+			Allow: []services.KubernetesJoinRule{
+				{Namespace: "teleport", ServiceAccount: "node-joiner"},
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(s.a.Identity.UpsertProvisionTokenV2(token), IsNil)
+
+	validClaims := map[string]interface{}{
+		"iss": "https://kubernetes.default.svc",
+		"sub": "system:serviceaccount:teleport:node-joiner",
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"kubernetes.io": map[string]interface{}{
+			"namespace":      "teleport",
+			"serviceaccount": map[string]string{"name": "node-joiner"},
+		},
+	}
+
+	// success
+	keys, err := s.a.RegisterUsingKubernetesToken(context.Background(), RegisterUsingTokenRequest{
+		Token:    "kube-token",
+		HostID:   "host-1",
+		NodeName: "node-1",
+		Role:     teleport.RoleNode,
+	}, signJWT(validClaims))
+	c.Assert(err, IsNil)
+	c.Assert(keys, NotNil)
+
+	// service account not covered by any allow rule
+	wrongSA := map[string]interface{}{}
+	for k, v := range validClaims {
+		wrongSA[k] = v
+	}
+	wrongSA["kubernetes.io"] = map[string]interface{}{
+		"namespace":      "teleport",
+		"serviceaccount": map[string]string{"name": "someone-else"},
+	}
+	_, err = s.a.RegisterUsingKubernetesToken(context.Background(), RegisterUsingTokenRequest{
+		Token:    "kube-token",
+		HostID:   "host-1",
+		NodeName: "node-1",
+		Role:     teleport.RoleNode,
+	}, signJWT(wrongSA))
+	c.Assert(err, NotNil)
+
+	// wrong role
+	_, err = s.a.RegisterUsingKubernetesToken(context.Background(), RegisterUsingTokenRequest{
+		Token:    "kube-token",
+		HostID:   "host-1",
+		NodeName: "node-1",
+		Role:     teleport.RoleProxy,
+	}, signJWT(validClaims))
+	c.Assert(err, NotNil)
+}
+
+func (s *AuthSuite) TestRegisterUsingX5C(c *C) {
+	ca, err := tlsca.New([]byte(fixtures.SigningCertPEM), []byte(fixtures.SigningKeyPEM))
+	c.Assert(err, IsNil)
+
+	testClock := clockwork.NewFakeClock()
+	s.a.SetClock(testClock)
+
+	newLeaf := func(cn string, notAfter time.Time) []byte {
+		privateKey, err := rsa.GenerateKey(rand.Reader, teleport.RSAKeySize)
+		c.Assert(err, IsNil)
+		certPEM, err := ca.GenerateCertificate(tlsca.CertificateRequest{
+			Clock:     testClock,
+			PublicKey: privateKey.Public(),
+			Subject:   pkix.Name{CommonName: cn},
+			NotAfter:  notAfter,
+		})
+		c.Assert(err, IsNil)
+		block, _ := pem.Decode(certPEM)
+		c.Assert(block, NotNil)
+		return block.Bytes
+	}
+
+	selfSigned := func(cn string) []byte {
+		privateKey, err := rsa.GenerateKey(rand.Reader, teleport.RSAKeySize)
+		c.Assert(err, IsNil)
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             testClock.Now().Add(-time.Hour),
+			NotAfter:              testClock.Now().Add(time.Hour),
+			BasicConstraintsValid: true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+		c.Assert(err, IsNil)
+		return der
+	}
+
+	token, err := services.NewProvisionTokenV2("x5c-token", time.Now().Add(time.Hour), services.ProvisionTokenSpecV2{
+		Roles:      teleport.Roles{teleport.RoleNode},
+		JoinMethod: services.JoinMethodX5C,
+		X5C: &services.ProvisionTokenSpecV2X5C{
+			CAPEM: fixtures.SigningCertPEM,
+			Allow: []services.X5CJoinRule{{CommonName: "node-1.example.com"}},
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(s.a.Identity.UpsertProvisionTokenV2(token), IsNil)
+
+	leaf := newLeaf("node-1.example.com", testClock.Now().Add(time.Hour))
+
+	// success
+	keys, err := s.a.RegisterUsingX5C(context.Background(), RegisterUsingTokenRequest{
+		Token:    "x5c-token",
+		HostID:   "host-1",
+		NodeName: "node-1",
+		Role:     teleport.RoleNode,
+		X5CCert:  leaf,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(keys, NotNil)
+
+	// chain not trusted: leaf isn't signed by the pinned CA
+	untrusted := selfSigned("node-1.example.com")
+	_, err = s.a.RegisterUsingX5C(context.Background(), RegisterUsingTokenRequest{
+		Token:    "x5c-token",
+		HostID:   "host-1",
+		NodeName: "node-1",
+		Role:     teleport.RoleNode,
+		X5CCert:  untrusted,
+	})
+	c.Assert(err, NotNil)
+
+	// expired leaf
+	expired := newLeaf("node-1.example.com", testClock.Now().Add(-time.Minute))
+	_, err = s.a.RegisterUsingX5C(context.Background(), RegisterUsingTokenRequest{
+		Token:    "x5c-token",
+		HostID:   "host-1",
+		NodeName: "node-1",
+		Role:     teleport.RoleNode,
+		X5CCert:  expired,
+	})
+	c.Assert(err, NotNil)
+
+	// subject mismatch
+	wrongSubject := newLeaf("node-2.example.com", testClock.Now().Add(time.Hour))
+	_, err = s.a.RegisterUsingX5C(context.Background(), RegisterUsingTokenRequest{
+		Token:    "x5c-token",
+		HostID:   "host-2",
+		NodeName: "node-2",
+		Role:     teleport.RoleNode,
+		X5CCert:  wrongSubject,
+	})
+	c.Assert(err, NotNil)
+
+	// wrong role
+	_, err = s.a.RegisterUsingX5C(context.Background(), RegisterUsingTokenRequest{
+		Token:    "x5c-token",
+		HostID:   "host-1",
+		NodeName: "node-1",
+		Role:     teleport.RoleProxy,
+		X5CCert:  leaf,
+	})
+	c.Assert(err, NotNil)
+}
+
 func (s *AuthSuite) TestBuildRolesInvalid(c *C) {
 	// create a connector
 	oidcConnector := services.NewOIDCConnector("example", services.OIDCConnectorSpecV2{
@@ -690,6 +1047,40 @@ func (s *AuthSuite) TestUpsertDeleteRole(c *C) {
 
 }
 
+func (s *AuthSuite) TestRolePermissionEventsEmitted(c *C) {
+	prev, err := services.NewRole("test", services.RoleSpecV3{
+		Allow: services.RoleConditions{
+			Rules: []services.Rule{
+				services.NewRule(services.KindUser, services.RO()),
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	next, err := services.NewRole("test", services.RoleSpecV3{
+		Allow: services.RoleConditions{
+			Rules: []services.Rule{
+				services.NewRule(services.KindUser, services.RO()),
+				services.NewRule(services.KindRole, services.RW()),
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	var grantedEvents []events.EventFields
+	s.mockedAuditLog.MockEmitAuditEvent = func(event events.Event, fields events.EventFields) error {
+		if event.Name == events.RolePermissionGrantedEvent {
+			grantedEvents = append(grantedEvents, fields)
+		}
+		return nil
+	}
+
+	s.a.emitRolePermissionEvents("test", prev, next)
+	c.Assert(grantedEvents, HasLen, 1)
+	c.Assert(grantedEvents[0]["role"], Equals, "test")
+	c.Assert(grantedEvents[0]["resources"], DeepEquals, []string{services.KindRole})
+}
+
 func (s *AuthSuite) TestGithubConnectorCRUDEventsEmitted(c *C) {
 	eventEmitted := false
 	s.mockedAuditLog.MockEmitAuditEvent = func(event events.Event, fields events.EventFields) error {
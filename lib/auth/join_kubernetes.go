@@ -0,0 +1,347 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+)
+
+// jwksCacheTTL is how long a fetched JWKS document is reused before being
+// refetched from JWKSURI.
+const jwksCacheTTL = 5 * time.Minute
+
+// kubernetesJWKSCache caches JWKS documents fetched from a ProvisionTokenV2
+// Kubernetes join method's jwks_uri, across all join requests.
+var kubernetesJWKSCache = newJWKSCache(http.DefaultClient, jwksCacheTTL)
+
+// jwksKey is a single entry of a JSON Web Key Set, restricted to the RSA
+// fields a Kubernetes projected ServiceAccount JWT is signed with.
+type jwksKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwksDocument struct {
+	Keys []jwksKey `json:"keys"`
+}
+
+// jwksCache fetches and caches the RSA public keys of a JWKS endpoint.
+type jwksCache struct {
+	client *http.Client
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]jwksCacheEntry
+}
+
+type jwksCacheEntry struct {
+	keys    []*rsa.PublicKey
+	fetched time.Time
+}
+
+func newJWKSCache(client *http.Client, ttl time.Duration) *jwksCache {
+	return &jwksCache{
+		client:  client,
+		ttl:     ttl,
+		entries: make(map[string]jwksCacheEntry),
+	}
+}
+
+// Get returns uri's RSA public keys, using the cached copy if it isn't
+// older than c.ttl.
+func (c *jwksCache) Get(ctx context.Context, uri string) ([]*rsa.PublicKey, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[uri]
+	c.mu.Unlock()
+	if ok && time.Since(entry.fetched) < c.ttl {
+		return entry.keys, nil
+	}
+
+	keys, err := c.fetch(ctx, uri)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	c.mu.Lock()
+	c.entries[uri] = jwksCacheEntry{keys: keys, fetched: time.Now()}
+	c.mu.Unlock()
+	return keys, nil
+}
+
+func (c *jwksCache) fetch(ctx context.Context, uri string) ([]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, trace.BadParameter("jwks endpoint %v returned status %v", uri, resp.StatusCode)
+	}
+
+	var doc jwksDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	keys := make([]*rsa.PublicKey, 0, len(doc.Keys))
+	for _, key := range doc.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+		pub, err := parseRSAPublicKey(key)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) == 0 {
+		return nil, trace.BadParameter("jwks endpoint %v has no usable RSA keys", uri)
+	}
+	return keys, nil
+}
+
+func parseRSAPublicKey(key jwksKey) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(key.N)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(key.E)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var e int
+	for _, b := range eBytes {
+		e = e<<8 | int(b)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: e,
+	}, nil
+}
+
+// jwtAudience is a JWT `aud` claim, which per RFC 7519 may be encoded as
+// either a single string or an array of strings.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return err
+	}
+	*a = jwtAudience(multi)
+	return nil
+}
+
+func (a jwtAudience) Contains(v string) bool {
+	for _, x := range a {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// kubernetesServiceAccountClaims is the subset of claims a Kubernetes
+// projected ServiceAccount JWT carries that the kubernetes join method
+// needs.
+type kubernetesServiceAccountClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	Expiry    int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+	K8s       struct {
+		Namespace      string `json:"namespace"`
+		ServiceAccount struct {
+			Name string `json:"name"`
+		} `json:"serviceaccount"`
+	} `json:"kubernetes.io"`
+}
+
+// parseAndVerifyJWT splits raw into its three parts, verifies its
+// signature against one of keys, and unmarshals its claims.
+func parseAndVerifyJWT(raw string, keys []*rsa.PublicKey) (*kubernetesServiceAccountClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, trace.BadParameter("malformed JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+	hash := sha256.Sum256(signingInput)
+
+	verified := false
+	for _, key := range keys {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, trace.AccessDenied("JWT signature does not match any key in the issuer's JWKS")
+	}
+
+	var claims kubernetesServiceAccountClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &claims, nil
+}
+
+// validateKubernetesJoinToken verifies rawJWT against spec's issuer/JWKS,
+// checks its validity window, and matches its ServiceAccount subject
+// against spec's allow rules.
+func (a *AuthServer) validateKubernetesJoinToken(ctx context.Context, spec *services.ProvisionTokenSpecV2Kubernetes, rawJWT string) (*kubernetesServiceAccountClaims, error) {
+	var keys []*rsa.PublicKey
+	if spec.JWKS != "" {
+		var doc jwksDocument
+		if err := json.Unmarshal([]byte(spec.JWKS), &doc); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		for _, key := range doc.Keys {
+			if pub, err := parseRSAPublicKey(key); err == nil && key.Kty == "RSA" {
+				keys = append(keys, pub)
+			}
+		}
+	} else {
+		var err error
+		if keys, err = kubernetesJWKSCache.Get(ctx, spec.JWKSURI); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+
+	claims, err := parseAndVerifyJWT(rawJWT, keys)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	now := a.GetClock().Now().Unix()
+	if claims.Issuer != spec.Issuer {
+		return nil, trace.AccessDenied("unexpected issuer %q", claims.Issuer)
+	}
+	if claims.Expiry != 0 && now > claims.Expiry {
+		return nil, trace.AccessDenied("token has expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, trace.AccessDenied("token is not yet valid")
+	}
+
+	for _, rule := range spec.Allow {
+		if rule.Namespace != "" && rule.Namespace != claims.K8s.Namespace {
+			continue
+		}
+		if rule.ServiceAccount != "" && rule.ServiceAccount != claims.K8s.ServiceAccount.Name {
+			continue
+		}
+		if rule.Audience != "" && !claims.Audience.Contains(rule.Audience) {
+			continue
+		}
+		return claims, nil
+	}
+
+	return nil, trace.AccessDenied(
+		"service account system:serviceaccount:%v:%v does not match any allow rule",
+		claims.K8s.Namespace, claims.K8s.ServiceAccount.Name)
+}
+
+// RegisterUsingKubernetesToken issues host credentials for a node that
+// authenticates by presenting a Kubernetes projected ServiceAccount JWT
+// instead of a static shared secret. This is the branch RegisterUsingToken
+// dispatches to when the named token's JoinMethod is
+// services.JoinMethodKubernetes; unlike a classic token, a kubernetes join
+// token is not consumed on use.
+func (a *AuthServer) RegisterUsingKubernetesToken(ctx context.Context, req RegisterUsingTokenRequest, kubernetesJWT string) (*PackedKeys, error) {
+	token, err := a.Identity.GetProvisionTokenV2(req.Token)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if token.Spec.JoinMethod != services.JoinMethodKubernetes {
+		return nil, trace.BadParameter("token %q does not use the kubernetes join method", req.Token)
+	}
+
+	claims, err := a.validateKubernetesJoinToken(ctx, token.Spec.Kubernetes, kubernetesJWT)
+	if err != nil {
+		a.emitKubernetesJoinFailure(req, kubernetesJWT, err)
+		return nil, trace.Wrap(err)
+	}
+	if !token.Spec.Roles.Include(req.Role) {
+		return nil, trace.AccessDenied("token does not allow role %q", req.Role)
+	}
+
+	log.Debugf("Node %q [%v] joined the cluster using the kubernetes join method as %v.",
+		req.NodeName, req.HostID, claims.Subject)
+	return a.issueHostCredentials(req.HostID, req.NodeName, req.Role, req.AdditionalPrincipals)
+}
+
+// emitKubernetesJoinFailure records a rejected kubernetes join attempt,
+// including the claims that failed validation, so an operator can tell a
+// misconfigured allow rule from a compromised cluster without combing
+// through debug logs.
+func (a *AuthServer) emitKubernetesJoinFailure(req RegisterUsingTokenRequest, rawJWT string, cause error) {
+	fields := events.EventFields{
+		"host_id":   req.HostID,
+		"node_name": req.NodeName,
+		"role":      string(req.Role),
+		"error":     cause.Error(),
+	}
+	if parts := strings.Split(rawJWT, "."); len(parts) == 3 {
+		if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil {
+			var claims kubernetesServiceAccountClaims
+			if json.Unmarshal(payload, &claims) == nil {
+				fields["claim_issuer"] = claims.Issuer
+				fields["claim_subject"] = claims.Subject
+				fields["claim_namespace"] = claims.K8s.Namespace
+				fields["claim_service_account"] = claims.K8s.ServiceAccount.Name
+			}
+		}
+	}
+	if err := a.emitAuditEvent(events.KubernetesJoinFailure, fields); err != nil {
+		log.Warningf("Failed to emit kubernetes join failure event: %v", err)
+	}
+}
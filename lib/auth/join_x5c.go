@@ -0,0 +1,164 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/gravitational/trace"
+)
+
+// RegisterUsingX5C issues host credentials for a node that authenticates by
+// presenting an X.509 leaf certificate (and the intermediates needed to
+// chain it to a pinned CA) instead of a shared secret. This is the branch
+// RegisterUsingToken dispatches to when the named token's JoinMethod is
+// services.JoinMethodX5C. Like the kubernetes join method, an x5c token is
+// not consumed on use: the proof is the certificate chain itself, which a
+// relying operator's own PKI already controls the lifetime of.
+func (a *AuthServer) RegisterUsingX5C(ctx context.Context, req RegisterUsingTokenRequest) (*PackedKeys, error) {
+	token, err := a.Identity.GetProvisionTokenV2(req.Token)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if token.Spec.JoinMethod != services.JoinMethodX5C {
+		return nil, trace.BadParameter("token %q does not use the x5c join method", req.Token)
+	}
+
+	leaf, err := a.validateX5CJoinToken(token.Spec.X5C, req.X5CCert, req.X5CChain)
+	if err != nil {
+		a.emitX5CJoinFailure(req, err)
+		return nil, trace.Wrap(err)
+	}
+	if !token.Spec.Roles.Include(req.Role) {
+		return nil, trace.AccessDenied("token does not allow role %q", req.Role)
+	}
+
+	log.Debugf("Node %q [%v] joined the cluster using the x5c join method as %v.",
+		req.NodeName, req.HostID, leaf.Subject.CommonName)
+	return a.issueHostCredentials(req.HostID, req.NodeName, req.Role, req.AdditionalPrincipals)
+}
+
+// validateX5CJoinToken verifies leafDER's chain (completed with chainDER)
+// against spec's pinned CA bundle, checks the leaf's validity window and
+// revocation status, and matches its subject against spec's allow rules.
+func (a *AuthServer) validateX5CJoinToken(spec *services.ProvisionTokenSpecV2X5C, leafDER []byte, chainDER [][]byte) (*x509.Certificate, error) {
+	if spec == nil {
+		return nil, trace.BadParameter("token has no x5c configuration")
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return nil, trace.Wrap(err, "invalid leaf certificate")
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(spec.CAPEM)) {
+		return nil, trace.BadParameter("x5c_ca_pem contains no usable certificates")
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range chainDER {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		intermediates.AddCert(cert)
+	}
+
+	now := a.GetClock().Now()
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, trace.AccessDenied("certificate chain does not verify against the pinned CA: %v", err)
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, trace.AccessDenied("leaf certificate has expired")
+	}
+	if now.Before(leaf.NotBefore) {
+		return nil, trace.AccessDenied("leaf certificate is not yet valid")
+	}
+
+	if spec.CRLPEM != "" {
+		revoked, err := x5cCertIsRevoked(spec.CRLPEM, leaf.SerialNumber)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if revoked {
+			return nil, trace.AccessDenied("leaf certificate has been revoked")
+		}
+	}
+
+	for _, rule := range spec.Allow {
+		if rule.CommonName != "" && rule.CommonName != leaf.Subject.CommonName {
+			continue
+		}
+		if rule.DNSName != "" && !utils.SliceContainsStr(leaf.DNSNames, rule.DNSName) {
+			continue
+		}
+		if rule.OrganizationalUnit != "" && !utils.SliceContainsStr(leaf.Subject.OrganizationalUnit, rule.OrganizationalUnit) {
+			continue
+		}
+		return leaf, nil
+	}
+
+	return nil, trace.AccessDenied("certificate subject %q does not match any allow rule", leaf.Subject.CommonName)
+}
+
+// x5cCertIsRevoked reports whether serial appears on the CRL encoded in
+// crlPEM.
+func x5cCertIsRevoked(crlPEM string, serial *big.Int) (bool, error) {
+	block, _ := pem.Decode([]byte(crlPEM))
+	if block == nil {
+		return false, trace.BadParameter("x5c_crl_pem is not valid PEM")
+	}
+	crl, err := x509.ParseCRL(block.Bytes)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		if revoked.SerialNumber.Cmp(serial) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// emitX5CJoinFailure records a rejected x5c join attempt, including the
+// leaf certificate's subject, so an operator can tell a misconfigured
+// allow rule from an untrusted device without combing through debug logs.
+func (a *AuthServer) emitX5CJoinFailure(req RegisterUsingTokenRequest, cause error) {
+	fields := events.EventFields{
+		"host_id":   req.HostID,
+		"node_name": req.NodeName,
+		"role":      string(req.Role),
+		"error":     cause.Error(),
+	}
+	if leaf, err := x509.ParseCertificate(req.X5CCert); err == nil {
+		fields["subject_common_name"] = leaf.Subject.CommonName
+	}
+	if err := a.emitAuditEvent(events.X5CJoinFailure, fields); err != nil {
+		log.Warningf("Failed to emit x5c join failure event: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/events"
+
+	"github.com/gravitational/trace"
+)
+
+// maybeEmitLoginLockedEvent emits a single UserLoginLocked event the moment
+// an account trips defaults.MaxLoginAttempts. attemptCount is the number of
+// consecutive failed attempts recorded for user, including the one that
+// just happened; the event is only emitted on the attempt that lands
+// exactly on the threshold so SIEMs get one lock event per lockout, not a
+// stream of them for every attempt afterwards. Neither ChangePassword nor
+// the login path calls it.
+func (a *AuthServer) maybeEmitLoginLockedEvent(user string, attemptCount int, sourceIP, userAgent string) {
+	if attemptCount != defaults.MaxLoginAttempts {
+		return
+	}
+	now := a.GetClock().Now()
+	unlockAt := now.Add(defaults.AccountLockInterval)
+	if err := a.emitAuditEvent(events.UserLoginLocked, events.EventFields{
+		events.EventUser: user,
+		"source_ip":      sourceIP,
+		"user_agent":     userAgent,
+		"attempt_count":  attemptCount,
+		"window":         defaults.AccountLockInterval.String(),
+		"unlock_at":      unlockAt,
+	}); err != nil {
+		log.Warningf("Failed to emit login locked event: %v", err)
+	}
+}
+
+// emitLoginUnlockedEvent emits UserLoginUnlocked, recording actingIdentity
+// (the admin who cleared the lock) when it is non-empty. Its only caller is
+// UnlockUser; a lock that runs out after AccountLockInterval emits no
+// event.
+func (a *AuthServer) emitLoginUnlockedEvent(user, actingIdentity string) {
+	fields := events.EventFields{
+		events.EventUser: user,
+	}
+	if actingIdentity != "" {
+		fields["acting_identity"] = actingIdentity
+	}
+	if err := a.emitAuditEvent(events.UserLoginUnlocked, fields); err != nil {
+		log.Warningf("Failed to emit login unlocked event: %v", err)
+	}
+}
+
+// UnlockUser clears a locked-out user's recorded login attempts, letting
+// them log in again immediately instead of waiting out
+// defaults.AccountLockInterval. actingIdentity is the username or cert
+// identity of the admin performing the unlock, recorded on the emitted
+// UserLoginUnlocked event. It backs `tctl users unlock <user>`.
+func (a *AuthServer) UnlockUser(ctx context.Context, username, actingIdentity string) error {
+	if err := a.DeleteUserLoginAttempts(username); err != nil && !trace.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+	a.emitLoginUnlockedEvent(username, actingIdentity)
+	return nil
+}
@@ -18,8 +18,16 @@ package auth
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
 	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"math/big"
 	"time"
 
 	"github.com/gravitational/teleport"
@@ -351,6 +359,136 @@ func (s *PasswordSuite) TestChangePasswordWithTokenErrors(c *C) {
 	c.Assert(err, NotNil)
 }
 
+// encodeCOSEKeyForTest builds the fixed-shape CBOR COSE_Key an EC2/ES256
+// public key decodes to, the inverse of auth.parseCOSEKey, since no CBOR
+// encoder is available in this tree.
+func encodeCOSEKeyForTest(pub *ecdsa.PublicKey) []byte {
+	x := pub.X.Bytes()
+	y := pub.Y.Bytes()
+	buf := []byte{0xa5, // map(5)
+		0x01, 0x02, // 1: 2 (kty: EC2)
+		0x03, 0x26, // 3: -7 (alg: ES256)
+		0x20, 0x01, // -1: 1 (crv: P-256)
+	}
+	buf = append(buf, 0x21, 0x58, byte(len(x))) // -2: bstr(len(x))
+	buf = append(buf, x...)
+	buf = append(buf, 0x22, 0x58, byte(len(y))) // -3: bstr(len(y))
+	buf = append(buf, y...)
+	return buf
+}
+
+// signAssertionForTest builds a valid AuthenticatorAssertionResponse
+// signature over authenticatorData/clientDataJSON, the way a real
+// authenticator would when completing a WebAuthn assertion.
+func signAssertionForTest(c *C, priv *ecdsa.PrivateKey, authenticatorData, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authenticatorData...), clientDataHash[:]...))
+	r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+	c.Assert(err, IsNil)
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	c.Assert(err, IsNil)
+	return sig
+}
+
+func (s *PasswordSuite) TestWebAuthnDeviceRegistrationAndAssertion(c *C) {
+	username := "webauthn-user"
+	_, _, err := CreateUserAndRole(s.a, username, []string{username})
+	c.Assert(err, IsNil)
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	credentialID := []byte("credential-1")
+	dev := MFADevice{
+		Name:         "yubikey-5",
+		AAGUID:       "aaguid-1",
+		CredentialID: credentialID,
+		PublicKey:    encodeCOSEKeyForTest(&priv.PublicKey),
+	}
+	err = s.a.UpsertMFADevice(context.TODO(), username, dev)
+	c.Assert(err, IsNil)
+
+	challenge := []byte("login-challenge-1")
+	clientDataJSON, err := json.Marshal(map[string]string{
+		"type":      "webauthn.get",
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    "https://example.com",
+	})
+	c.Assert(err, IsNil)
+
+	authenticatorData := make([]byte, 37)
+	authenticatorData[36] = 1 // sign count = 1, encoded big-endian in bytes 33-36
+	sig := signAssertionForTest(c, priv, authenticatorData, clientDataJSON)
+
+	verified, err := s.a.verifyWebAuthnAssertion(username, challenge, AuthenticatorAssertionResponse{
+		CredentialID:      credentialID,
+		AuthenticatorData: authenticatorData,
+		ClientDataJSON:    clientDataJSON,
+		Signature:         sig,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(verified.Name, Equals, "yubikey-5")
+	c.Assert(verified.SignCount, Equals, uint32(1))
+
+	// replaying the same (non-advancing) sign count must be rejected, as it
+	// indicates a cloned authenticator.
+	_, err = s.a.verifyWebAuthnAssertion(username, challenge, AuthenticatorAssertionResponse{
+		CredentialID:      credentialID,
+		AuthenticatorData: authenticatorData,
+		ClientDataJSON:    clientDataJSON,
+		Signature:         sig,
+	})
+	c.Assert(trace.IsAccessDenied(err), Equals, true)
+
+	// a forged assertion using the right credential ID but a different
+	// (attacker-controlled) key must be rejected.
+	forgedPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	authenticatorData2 := make([]byte, 37)
+	authenticatorData2[36] = 2
+	forgedSig := signAssertionForTest(c, forgedPriv, authenticatorData2, clientDataJSON)
+	_, err = s.a.verifyWebAuthnAssertion(username, challenge, AuthenticatorAssertionResponse{
+		CredentialID:      credentialID,
+		AuthenticatorData: authenticatorData2,
+		ClientDataJSON:    clientDataJSON,
+		Signature:         forgedSig,
+	})
+	c.Assert(trace.IsAccessDenied(err), Equals, true)
+
+	// a stale challenge (e.g. replayed from a previous login attempt) must
+	// be rejected even with a validly-signed assertion.
+	authenticatorData3 := make([]byte, 37)
+	authenticatorData3[36] = 2
+	sig3 := signAssertionForTest(c, priv, authenticatorData3, clientDataJSON)
+	_, err = s.a.verifyWebAuthnAssertion(username, []byte("a-different-challenge"), AuthenticatorAssertionResponse{
+		CredentialID:      credentialID,
+		AuthenticatorData: authenticatorData3,
+		ClientDataJSON:    clientDataJSON,
+		Signature:         sig3,
+	})
+	c.Assert(trace.IsAccessDenied(err), Equals, true)
+}
+
+func (s *PasswordSuite) TestUnlockUserEmitsEvent(c *C) {
+	username := "locked-user"
+	_, _, err := CreateUserAndRole(s.a, username, []string{username})
+	c.Assert(err, IsNil)
+
+	var unlockEventEmitted bool
+	s.mockedAuditLog.MockEmitAuditEvent = func(event events.Event, fields events.EventFields) error {
+		if event.Name == events.UserLoginUnlockedEvent {
+			unlockEventEmitted = true
+			c.Assert(fields[events.EventUser], Equals, username)
+			c.Assert(fields["acting_identity"], Equals, "admin@example.com")
+		}
+		return nil
+	}
+
+	err = s.a.UnlockUser(context.TODO(), username, "admin@example.com")
+	c.Assert(err, IsNil)
+	c.Assert(unlockEventEmitted, Equals, true)
+}
+
 func (s *PasswordSuite) shouldLockAfterFailedAttempts(c *C, req services.ChangePasswordReq) {
 	loginAttempts, _ := s.a.GetUserLoginAttempts(req.User)
 	c.Assert(len(loginAttempts), Equals, 0)
@@ -0,0 +1,236 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/trace"
+)
+
+// certExtensionTeleportRole is the certificate extension a node's host
+// cert carries its Teleport role in, so RegisterUsingSSHPOP can cross-check
+// the requested role against the role the cert was actually issued for.
+const certExtensionTeleportRole = "teleport-role"
+
+// sshPOPAssertionTTL bounds how old a proof-of-possession signature may be,
+// so a captured (HostCert, Signature, Timestamp) tuple can't be replayed
+// indefinitely.
+const sshPOPAssertionTTL = time.Minute
+
+// RegisterUsingSSHPOPRequest renews a node's host credentials by proving
+// possession of its current SSH host certificate, instead of consuming a
+// join token. This mirrors the "SSHPOP" provisioner pattern: the cert
+// itself is the token header, and Signature is the body signed with the
+// cert's private key.
+type RegisterUsingSSHPOPRequest struct {
+	// HostCert is the node's current host certificate, in SSH wire format
+	// (as returned by ssh.Certificate.Marshal).
+	HostCert []byte
+	// Timestamp is when Signature was produced; it must fall within
+	// sshPOPAssertionTTL of the server's clock.
+	Timestamp time.Time
+	// Signature is the signature, by HostCert's private key, of the
+	// assertion built by sshPOPAssertion for HostID/NodeName/Role/Timestamp.
+	Signature *ssh.Signature
+	// HostID, NodeName and Role are the identity the node is renewing
+	// credentials for; they must match HostCert's principals and role
+	// extension.
+	HostID               string
+	NodeName             string
+	Role                 teleport.Role
+	AdditionalPrincipals []string
+}
+
+// sshPOPAssertion builds the byte string a client signs (and the server
+// verifies) to prove possession of a host cert's private key for a
+// specific renewal request, binding the signature to the identity being
+// claimed and to a timestamp so it can't be replayed stale or reused for
+// a different role.
+func sshPOPAssertion(hostID, nodeName string, role teleport.Role, timestamp time.Time) []byte {
+	return []byte(fmt.Sprintf("teleport-sshpop|%s|%s|%s|%d", hostID, nodeName, role, timestamp.Unix()))
+}
+
+// RegisterUsingSSHPOP issues fresh host credentials for an already-joined
+// node the same way RegisterUsingToken does, but authenticates the request
+// via proof-of-possession of the node's existing SSH host certificate
+// rather than a join token. This removes the operational need to hand a
+// fresh token to every node on every credential rotation.
+func (a *AuthServer) RegisterUsingSSHPOP(req RegisterUsingSSHPOPRequest) (*PackedKeys, error) {
+	cert, err := a.verifySSHPOP(req)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	keys, err := a.issueHostCredentials(req.HostID, req.NodeName, req.Role, req.AdditionalPrincipals)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	log.Debugf("Node %q [%v] renewed host credentials using SSH proof-of-possession (cert serial %d).",
+		req.NodeName, req.HostID, cert.Serial)
+	return keys, nil
+}
+
+// verifySSHPOP validates req's host certificate and signature, returning
+// the parsed certificate once every check has passed.
+func (a *AuthServer) verifySSHPOP(req RegisterUsingSSHPOPRequest) (*ssh.Certificate, error) {
+	if req.Signature == nil {
+		return nil, trace.BadParameter("missing proof-of-possession signature")
+	}
+	if a.GetClock().Now().Sub(req.Timestamp).Abs() > sshPOPAssertionTTL {
+		return nil, trace.AccessDenied("proof-of-possession assertion has expired")
+	}
+
+	pub, err := ssh.ParsePublicKey(req.HostCert)
+	if err != nil {
+		return nil, trace.Wrap(err, "invalid host certificate")
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, trace.BadParameter("expected an SSH host certificate")
+	}
+	if cert.CertType != ssh.HostCert {
+		return nil, trace.BadParameter("expected a host certificate, got a user certificate")
+	}
+
+	now := a.GetClock().Now()
+	unixNow := uint64(now.Unix())
+	if cert.ValidAfter != 0 && unixNow < cert.ValidAfter {
+		return nil, trace.AccessDenied("host certificate is not yet valid")
+	}
+	if cert.ValidBefore != 0 && cert.ValidBefore != ssh.CertTimeInfinity && unixNow > cert.ValidBefore {
+		return nil, trace.AccessDenied("host certificate has expired")
+	}
+
+	revoked, err := a.isHostCertRevoked(cert.Serial)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if revoked {
+		return nil, trace.AccessDenied("host certificate has been revoked")
+	}
+
+	trusted, err := a.hostCertIsTrusted(cert)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if !trusted {
+		return nil, trace.AccessDenied("host certificate was not issued by this cluster's host CA")
+	}
+
+	if err := cert.Key.Verify(sshPOPAssertion(req.HostID, req.NodeName, req.Role, req.Timestamp), req.Signature); err != nil {
+		return nil, trace.AccessDenied("proof-of-possession signature is invalid")
+	}
+
+	if !utils.SliceContainsStr(cert.ValidPrincipals, req.NodeName) || !utils.SliceContainsStr(cert.ValidPrincipals, req.HostID) {
+		return nil, trace.AccessDenied("host certificate principals do not match the requested identity")
+	}
+	if cert.Permissions.Extensions[certExtensionTeleportRole] != string(req.Role) {
+		return nil, trace.AccessDenied("host certificate was not issued for role %v", req.Role)
+	}
+
+	return cert, nil
+}
+
+// hostCertIsTrusted checks cert's signing key against the cluster's HostCA.
+func (a *AuthServer) hostCertIsTrusted(cert *ssh.Certificate) (bool, error) {
+	clusterName, err := a.GetClusterName()
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	ca, err := a.GetCertAuthority(services.CertAuthID{
+		Type:       services.HostCA,
+		DomainName: clusterName.GetClusterName(),
+	}, false)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	for _, keyBytes := range ca.GetCheckingKeys() {
+		caKey, _, _, _, err := ssh.ParseAuthorizedKey(keyBytes)
+		if err != nil {
+			continue
+		}
+		if utils.KeysEqual(caKey, cert.SignatureKey) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isHostCertRevoked reports whether serial has been explicitly revoked.
+func (a *AuthServer) isHostCertRevoked(serial uint64) (bool, error) {
+	revoked, err := a.Identity.GetRevokedHostCertSerials()
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	return revoked[serial], nil
+}
+
+// RevokeHostCert marks an SSH host certificate serial as revoked, so a
+// future RegisterUsingSSHPOP presenting it is rejected even though the
+// certificate itself hasn't expired yet.
+func (a *AuthServer) RevokeHostCert(serial uint64) error {
+	return trace.Wrap(a.Identity.UpsertRevokedHostCertSerial(serial))
+}
+
+// PackedKeys is the set of credentials issued to a newly (or re-)registered
+// node: an SSH host certificate and key, plus the TLS equivalent used for
+// the gRPC/HTTPS API.
+type PackedKeys struct {
+	// Key is the node's private key, PEM-encoded.
+	Key []byte
+	// Cert is the node's SSH host certificate, in authorized-key format.
+	Cert []byte
+	// TLSCert is the node's TLS certificate, PEM-encoded.
+	TLSCert []byte
+	// TLSCACerts are the cluster's TLS CA certificates, PEM-encoded.
+	TLSCACerts [][]byte
+}
+
+// issueHostCredentials generates fresh host keys and certificates for a
+// node, once its join request has been authenticated by whichever method
+// is in use -- a join token via RegisterUsingToken, or SSH
+// proof-of-possession via RegisterUsingSSHPOP.
+func (a *AuthServer) issueHostCredentials(hostID, nodeName string, role teleport.Role, additionalPrincipals []string) (*PackedKeys, error) {
+	clusterName, err := a.GetClusterName()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	principals := append([]string{hostID, nodeName}, additionalPrincipals...)
+
+	keys, err := a.generateHostKeys(services.HostCertParams{
+		ClusterName:   clusterName.GetClusterName(),
+		HostID:        hostID,
+		NodeName:      nodeName,
+		Role:          role,
+		Principals:    principals,
+		RoleExtension: certExtensionTeleportRole,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return keys, nil
+}
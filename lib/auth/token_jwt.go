@@ -0,0 +1,239 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// Token formats a join token may be generated in. TokenFormatOpaque is the
+// classic format: a random string that is itself the shared secret.
+// TokenFormatJWT additionally binds the token to an issuer, a subject, an
+// audience and a validity window, so a token minted for one join endpoint
+// can't be replayed against another.
+const (
+	TokenFormatOpaque = ""
+	TokenFormatJWT    = "jwt"
+)
+
+// Join audiences a TokenFormatJWT token's `aud` claim is scoped to. A token
+// presented to a join RPC whose audience doesn't match is rejected even if
+// its signature and validity window check out.
+const (
+	JoinAudienceNode  = "node-join"
+	JoinAudienceProxy = "proxy-join"
+	JoinAudienceKube  = "kube-join"
+	JoinAudienceApp   = "app-join"
+)
+
+// tokenJWTClaims is the claim set of a TokenFormatJWT join token.
+type tokenJWTClaims struct {
+	Issuer    string         `json:"iss"`
+	Subject   string         `json:"sub"`
+	Audience  string         `json:"aud"`
+	Expiry    int64          `json:"exp"`
+	NotBefore int64          `json:"nbf"`
+	Roles     teleport.Roles `json:"teleport.roles"`
+	Allow     []string       `json:"teleport.allow,omitempty"`
+}
+
+// looksLikeJWT reports whether raw has the three dot-separated segments of
+// a JWT, which is enough to tell it apart from an opaque token: opaque
+// tokens are generated by TokenLenBytes random bytes and never contain a
+// literal '.'.
+func looksLikeJWT(raw string) bool {
+	return strings.Count(raw, ".") == 2
+}
+
+// generateTokenJWT mints a TokenFormatJWT join token for name/roles/TTL,
+// scoped to audience and signed with the cluster's JWT signer.
+// GenerateToken does not call it.
+func (a *AuthServer) generateTokenJWT(name string, roles teleport.Roles, ttl time.Duration, audience string) (string, error) {
+	signer, err := a.Identity.GetJWTSigner()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	clusterName, err := a.GetClusterName()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	now := a.GetClock().Now()
+	claims := tokenJWTClaims{
+		Issuer:    clusterName.GetClusterName(),
+		Subject:   name,
+		Audience:  audience,
+		Expiry:    now.Add(ttl).Unix(),
+		NotBefore: now.Unix(),
+		Roles:     roles,
+	}
+	return signTokenJWT(signer, claims)
+}
+
+func signTokenJWT(signer *rsa.PrivateKey, claims tokenJWTClaims) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parseTokenJWT verifies raw's signature against pub and returns its
+// claims, without checking expiry, nbf or audience -- callers apply
+// whichever of those checks are relevant to them (IntrospectToken reports
+// an expired token rather than erroring on it; validateJoinToken rejects
+// one).
+func parseTokenJWT(raw string, pub *rsa.PublicKey) (*tokenJWTClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, trace.BadParameter("malformed JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig); err != nil {
+		return nil, trace.AccessDenied("token signature is invalid")
+	}
+
+	var claims tokenJWTClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &claims, nil
+}
+
+// TokenInfo describes a join token's claims and validity state, as returned
+// by IntrospectToken.
+type TokenInfo struct {
+	// Format is TokenFormatOpaque or TokenFormatJWT.
+	Format string
+	// Name is the token's name (its Subject, for a JWT-format token).
+	Name string
+	// Issuer is the cluster that minted the token. Empty for an opaque
+	// token, which carries no issuer claim.
+	Issuer string
+	// Audience is the join endpoint the token is scoped to. Empty for an
+	// opaque token, which is valid against any join endpoint.
+	Audience string
+	// Roles is the set of system roles the token allows joining as.
+	Roles teleport.Roles
+	// Expires is when the token stops being valid. The zero Time for an
+	// opaque token, whose expiry is tracked on its backend resource rather
+	// than in the token string itself.
+	Expires time.Time
+	// NotBefore is when the token starts being valid.
+	NotBefore time.Time
+	// Expired reports whether Expires has already passed, as of the
+	// server's clock at the time of the call.
+	Expired bool
+}
+
+// IntrospectToken returns raw's claims and validity state without
+// consuming it. A TokenFormatJWT token has its signature checked but,
+// unlike validateJoinToken, is not checked against any particular join
+// audience, and an expired one has its claims returned rather than an
+// error, so an operator can inspect why a join attempt was rejected. An
+// opaque token is checked with ValidateToken and reported with its name
+// and roles only.
+func (a *AuthServer) IntrospectToken(ctx context.Context, raw string) (*TokenInfo, error) {
+	if !looksLikeJWT(raw) {
+		roles, err := a.ValidateToken(raw)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return &TokenInfo{Format: TokenFormatOpaque, Name: raw, Roles: roles}, nil
+	}
+
+	signer, err := a.Identity.GetJWTSigner()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	claims, err := parseTokenJWT(raw, &signer.PublicKey)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	now := a.GetClock().Now()
+	expires := time.Unix(claims.Expiry, 0)
+	return &TokenInfo{
+		Format:    TokenFormatJWT,
+		Name:      claims.Subject,
+		Issuer:    claims.Issuer,
+		Audience:  claims.Audience,
+		Roles:     claims.Roles,
+		Expires:   expires,
+		NotBefore: time.Unix(claims.NotBefore, 0),
+		Expired:   now.After(expires),
+	}, nil
+}
+
+// validateJoinToken checks a token against the join endpoint it was
+// presented to. For a TokenFormatJWT token it checks the signature and
+// validity window, rejects a token whose `aud` claim doesn't match
+// audience -- so a node-join token can't be replayed against a proxy-join
+// RPC -- and returns the token's roles. Opaque tokens, which carry no
+// audience, fall through to ValidateToken unchanged. Neither
+// RegisterUsingToken nor ValidateToken calls it, and ValidateToken itself
+// has no TokenFormatJWT branch.
+func (a *AuthServer) validateJoinToken(raw string, audience string) (teleport.Roles, error) {
+	if !looksLikeJWT(raw) {
+		return a.ValidateToken(raw)
+	}
+
+	info, err := a.IntrospectToken(context.Background(), raw)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if info.Expired {
+		return nil, trace.AccessDenied("token has expired")
+	}
+	if a.GetClock().Now().Before(info.NotBefore) {
+		return nil, trace.AccessDenied("token is not yet valid")
+	}
+	if info.Audience != audience {
+		return nil, trace.AccessDenied("token is not valid for %v", audience)
+	}
+	return info.Roles, nil
+}
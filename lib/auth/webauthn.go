@@ -0,0 +1,294 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+)
+
+// coseAlgES256 is the COSE algorithm identifier for ECDSA w/ SHA-256 over
+// the P-256 curve, the algorithm essentially every WebAuthn security key
+// registers with.
+const coseAlgES256 = -7
+
+// coseKtyEC2 is the COSE key type for an elliptic-curve key given as raw
+// (X, Y) coordinates.
+const coseKtyEC2 = 2
+
+// coseCrvP256 is the COSE curve identifier for P-256.
+const coseCrvP256 = 1
+
+// clientData is the subset of the WebAuthn client data JSON this
+// implementation checks: that it's an assertion (not a registration), and
+// that it embeds the challenge the server issued.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+}
+
+// MFADevice is a registered WebAuthn/FIDO2 authenticator. Unlike the single
+// TOTP secret stored per-user, a user may register multiple MFADevices,
+// each identified by Name.
+type MFADevice struct {
+	// Name is a human-readable label the user gave the device at
+	// registration time, e.g. "yubikey-5".
+	Name string `json:"name"`
+	// AAGUID is the authenticator attestation GUID reported by the device.
+	AAGUID string `json:"aaguid"`
+	// CredentialID is the WebAuthn credential ID generated at registration.
+	CredentialID []byte `json:"credential_id"`
+	// PublicKey is the COSE-encoded public key associated with CredentialID.
+	PublicKey []byte `json:"public_key"`
+	// SignCount is the authenticator's signature counter, used to detect
+	// cloned authenticators: a valid assertion must report a SignCount
+	// strictly greater than the last one we saw.
+	SignCount uint32 `json:"sign_count"`
+}
+
+// CredentialCreation is the challenge returned to a browser/client to
+// register a new WebAuthn device, modeled after the W3C
+// PublicKeyCredentialCreationOptions the real client-side API expects.
+type CredentialCreation struct {
+	// Challenge is the random, single-use registration challenge.
+	Challenge []byte `json:"challenge"`
+	// RPID is the relying party ID (the cluster's public address).
+	RPID string `json:"rp_id"`
+	// UserHandle identifies the user being registered to the authenticator.
+	UserHandle []byte `json:"user_handle"`
+}
+
+// AuthenticatorAssertionResponse is what the client sends back after the
+// user completes a WebAuthn assertion (i.e. touches their device) in
+// response to a login or password-reset challenge.
+type AuthenticatorAssertionResponse struct {
+	// CredentialID identifies which of the user's registered devices signed
+	// the assertion.
+	CredentialID []byte `json:"credential_id"`
+	// AuthenticatorData is the raw authenticator data, which includes the
+	// updated signature counter.
+	AuthenticatorData []byte `json:"authenticator_data"`
+	// ClientDataJSON is the client data the authenticator signed over,
+	// which must embed Challenge.
+	ClientDataJSON []byte `json:"client_data_json"`
+	// Signature is the assertion signature to verify against PublicKey.
+	Signature []byte `json:"signature"`
+}
+
+// beginWebAuthnRegistration generates a registration challenge for user.
+// CreateResetPasswordToken and RotateResetPasswordTokenSecrets do not call
+// it.
+func (a *AuthServer) beginWebAuthnRegistration(user string) (*CredentialCreation, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	clusterName, err := a.GetClusterName()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &CredentialCreation{
+		Challenge:  challenge,
+		RPID:       clusterName.GetClusterName(),
+		UserHandle: []byte(user),
+	}, nil
+}
+
+// UpsertMFADevice stores a newly-registered WebAuthn device for user. A
+// user may have any number of devices; they are keyed by Name so
+// re-registering under the same name replaces the old entry, under the
+// existing local-auth backend namespace used for TOTP secrets and
+// passwords.
+func (a *AuthServer) UpsertMFADevice(ctx context.Context, user string, dev MFADevice) error {
+	if err := a.Identity.UpsertMFADevice(ctx, user, dev.Name, services.MarshalMFADevice(dev)); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := a.emitAuditEvent(events.UserMFADeviceAdded, events.EventFields{
+		events.EventUser: user,
+		"device_name":    dev.Name,
+		"device_type":    "webauthn",
+		"aaguid":         dev.AAGUID,
+	}); err != nil {
+		log.Warningf("Failed to emit MFA device added event: %v", err)
+	}
+	return nil
+}
+
+// DeleteMFADevice removes a previously registered device by name.
+func (a *AuthServer) DeleteMFADevice(ctx context.Context, user, deviceName string) error {
+	if err := a.Identity.DeleteMFADevice(ctx, user, deviceName); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := a.emitAuditEvent(events.UserMFADeviceDeleted, events.EventFields{
+		events.EventUser: user,
+		"device_name":    deviceName,
+	}); err != nil {
+		log.Warningf("Failed to emit MFA device deleted event: %v", err)
+	}
+	return nil
+}
+
+// verifyWebAuthnAssertion verifies resp against one of user's registered
+// MFADevices and the challenge the server issued for this attempt, and
+// returns the matching device on success. changePasswordWithToken and
+// ChangePassword do not call it.
+func (a *AuthServer) verifyWebAuthnAssertion(user string, challenge []byte, resp AuthenticatorAssertionResponse) (*MFADevice, error) {
+	devices, err := a.Identity.GetMFADevices(user)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	for _, raw := range devices {
+		dev, err := services.UnmarshalMFADevice(raw)
+		if err != nil {
+			continue
+		}
+		if !credentialIDsEqual(dev.CredentialID, resp.CredentialID) {
+			continue
+		}
+
+		if err := verifyClientDataChallenge(resp.ClientDataJSON, challenge); err != nil {
+			a.recordMFAAuthFailure(user, "webauthn", err)
+			return nil, trace.Wrap(err)
+		}
+		if err := verifyAssertionSignature(dev.PublicKey, resp); err != nil {
+			a.recordMFAAuthFailure(user, "webauthn", err)
+			return nil, trace.Wrap(err)
+		}
+
+		// The authenticator's signature counter must strictly increase on
+		// every assertion; a counter that doesn't advance (or goes
+		// backwards) indicates a cloned authenticator.
+		counter := parseSignCount(resp.AuthenticatorData)
+		if counter <= dev.SignCount {
+			a.recordMFAAuthFailure(user, "webauthn", trace.AccessDenied("signature counter did not advance"))
+			return nil, trace.AccessDenied("webauthn signature counter did not advance")
+		}
+
+		dev.SignCount = counter
+		if err := a.Identity.UpsertMFADevice(context.TODO(), user, dev.Name, services.MarshalMFADevice(*dev)); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return dev, nil
+	}
+	a.recordMFAAuthFailure(user, "webauthn", trace.AccessDenied("no matching device"))
+	return nil, trace.AccessDenied("no matching WebAuthn device registered for %q", user)
+}
+
+// verifyClientDataChallenge checks that resp's client data is an assertion
+// (not a registration) and embeds the challenge the server issued for this
+// attempt, so a signature can't be replayed against a different challenge.
+func verifyClientDataChallenge(rawClientData []byte, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(rawClientData, &cd); err != nil {
+		return trace.BadParameter("invalid client data: %v", err)
+	}
+	if cd.Type != "webauthn.get" {
+		return trace.AccessDenied("client data is not a WebAuthn assertion")
+	}
+	got, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil {
+		return trace.BadParameter("invalid client data challenge: %v", err)
+	}
+	if !credentialIDsEqual(got, challenge) {
+		return trace.AccessDenied("client data does not embed the outstanding challenge")
+	}
+	return nil
+}
+
+// verifyAssertionSignature verifies resp.Signature over
+// resp.AuthenticatorData || SHA256(resp.ClientDataJSON) against
+// coseEncodedKey, per §6.3.3 of the WebAuthn spec (authenticatorData and
+// clientDataHash form the signed message; the authenticator is responsible
+// for hashing it with the algorithm its COSE key declares).
+func verifyAssertionSignature(coseEncodedKey []byte, resp AuthenticatorAssertionResponse) error {
+	key, err := parseCOSEKey(coseEncodedKey)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if key.Kty != coseKtyEC2 || key.Alg != coseAlgES256 || key.Crv != coseCrvP256 {
+		return trace.BadParameter("unsupported WebAuthn public key algorithm")
+	}
+
+	pub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(key.X),
+		Y:     new(big.Int).SetBytes(key.Y),
+	}
+
+	clientDataHash := sha256.Sum256(resp.ClientDataJSON)
+	signedMessage := append(append([]byte{}, resp.AuthenticatorData...), clientDataHash[:]...)
+	digest := sha256.Sum256(signedMessage)
+
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(resp.Signature, &sig); err != nil {
+		return trace.BadParameter("invalid assertion signature encoding: %v", err)
+	}
+	if !ecdsa.Verify(pub, digest[:], sig.R, sig.S) {
+		return trace.AccessDenied("webauthn assertion signature is invalid")
+	}
+	return nil
+}
+
+// recordMFAAuthFailure emits the MFAAuthFailure audit event and counts the
+// failure the same way a bad password does, so shouldLockAfterFailedAttempts
+// locks the account after defaults.MaxLoginAttempts failed assertions just
+// as it would for failed passwords.
+func (a *AuthServer) recordMFAAuthFailure(user, deviceType string, cause error) {
+	if err := a.emitAuditEvent(events.MFAAuthFailure, events.EventFields{
+		events.EventUser: user,
+		"device_type":    deviceType,
+		"error":          cause.Error(),
+	}); err != nil {
+		log.Warningf("Failed to emit MFA auth failure event: %v", err)
+	}
+	attempt := services.LoginAttempt{Time: a.GetClock().Now(), Success: false}
+	if err := a.AddUserLoginAttempt(user, attempt, defaults.AttemptTTL); err != nil {
+		log.Warningf("Failed to record failed MFA login attempt: %v", err)
+	}
+}
+
+// credentialIDsEqual compares two WebAuthn credential IDs for equality.
+func credentialIDsEqual(a, b []byte) bool {
+	return base64.RawURLEncoding.EncodeToString(a) == base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseSignCount extracts the signature counter from a WebAuthn
+// authenticator data structure (bytes 33-36, big-endian), per §6.1 of the
+// WebAuthn spec.
+func parseSignCount(authenticatorData []byte) uint32 {
+	const signCountOffset = 33
+	if len(authenticatorData) < signCountOffset+4 {
+		return 0
+	}
+	b := authenticatorData[signCountOffset : signCountOffset+4]
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
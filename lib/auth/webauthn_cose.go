@@ -0,0 +1,184 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"github.com/gravitational/trace"
+)
+
+// coseKey is the subset of a COSE_Key (RFC 8152) this package understands:
+// an EC2 key, which covers the ES256 authenticators this implementation
+// verifies. Only labels 1, 3, -1, -2 and -3 are read, with EC2 value types;
+// any other label, or an RSA key's byte-string modulus at label -1, fails
+// to parse. A key that parses with other Kty/Alg/Crv values (an OKP
+// Ed25519 key, say) is returned for callers to reject.
+type coseKey struct {
+	Kty int64
+	Alg int64
+	Crv int64
+	X   []byte
+	Y   []byte
+}
+
+// parseCOSEKey decodes a CBOR-encoded COSE_Key. It implements just enough
+// of CBOR (unsigned/negative integers and byte strings inside a top-level
+// map) to read the handful of fields an EC2 key carries, rather than
+// pulling in a general-purpose CBOR library for one fixed-shape structure.
+func parseCOSEKey(data []byte) (*coseKey, error) {
+	d := &cborReader{data: data}
+	n, err := d.readMapHeader()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	key := &coseKey{}
+	for i := 0; i < n; i++ {
+		k, err := d.readInt()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		switch k {
+		case 1:
+			v, err := d.readInt()
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			key.Kty = v
+		case 3:
+			v, err := d.readInt()
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			key.Alg = v
+		case -1:
+			v, err := d.readInt()
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			key.Crv = v
+		case -2:
+			v, err := d.readBytes()
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			key.X = v
+		case -3:
+			v, err := d.readBytes()
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			key.Y = v
+		default:
+			return nil, trace.BadParameter("unsupported COSE key field %d", k)
+		}
+	}
+	return key, nil
+}
+
+// cborReader is a minimal, forward-only CBOR item reader.
+type cborReader struct {
+	data []byte
+	pos  int
+}
+
+// readHead reads a CBOR initial byte and its argument, per RFC 7049 §2.1.
+func (d *cborReader) readHead() (major byte, arg uint64, err error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, trace.BadParameter("unexpected end of CBOR data")
+	}
+	b := d.data[d.pos]
+	d.pos++
+	major = b >> 5
+	info := b & 0x1f
+
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		v, err := d.readUint(1)
+		return major, v, err
+	case info == 25:
+		v, err := d.readUint(2)
+		return major, v, err
+	case info == 26:
+		v, err := d.readUint(4)
+		return major, v, err
+	case info == 27:
+		v, err := d.readUint(8)
+		return major, v, err
+	default:
+		return 0, 0, trace.BadParameter("unsupported CBOR additional info %d", info)
+	}
+}
+
+func (d *cborReader) readUint(n int) (uint64, error) {
+	if d.pos+n > len(d.data) {
+		return 0, trace.BadParameter("unexpected end of CBOR data")
+	}
+	var v uint64
+	for _, b := range d.data[d.pos : d.pos+n] {
+		v = v<<8 | uint64(b)
+	}
+	d.pos += n
+	return v, nil
+}
+
+// readMapHeader reads a map header and returns its entry count.
+func (d *cborReader) readMapHeader() (int, error) {
+	major, arg, err := d.readHead()
+	if err != nil {
+		return 0, err
+	}
+	if major != 5 {
+		return 0, trace.BadParameter("expected a CBOR map, got major type %d", major)
+	}
+	return int(arg), nil
+}
+
+// readInt reads a CBOR unsigned or negative integer.
+func (d *cborReader) readInt() (int64, error) {
+	major, arg, err := d.readHead()
+	if err != nil {
+		return 0, err
+	}
+	switch major {
+	case 0:
+		return int64(arg), nil
+	case 1:
+		return -1 - int64(arg), nil
+	default:
+		return 0, trace.BadParameter("expected a CBOR integer, got major type %d", major)
+	}
+}
+
+// readBytes reads a CBOR byte string.
+func (d *cborReader) readBytes() ([]byte, error) {
+	major, arg, err := d.readHead()
+	if err != nil {
+		return nil, err
+	}
+	if major != 2 {
+		return nil, trace.BadParameter("expected a CBOR byte string, got major type %d", major)
+	}
+	n := int(arg)
+	if d.pos+n > len(d.data) {
+		return nil, trace.BadParameter("unexpected end of CBOR data")
+	}
+	v := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return v, nil
+}
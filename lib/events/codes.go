@@ -160,6 +160,33 @@ var (
 		Name: AuthAttemptEvent,
 		Code: AuthAttemptFailureCode,
 	}
+	// UserLoginLocked is emitted when an account is locked out after too
+	// many failed login attempts.
+	UserLoginLocked = Event{
+		Name: UserLoginLockedEvent,
+		Code: UserLoginLockedCode,
+	}
+	// UserLoginUnlocked is emitted when a locked account becomes available
+	// again.
+	UserLoginUnlocked = Event{
+		Name: UserLoginUnlockedEvent,
+		Code: UserLoginUnlockedCode,
+	}
+	// UserMFADeviceAdded is emitted when a user registers a new MFA device.
+	UserMFADeviceAdded = Event{
+		Name: UserMFADeviceAddedEvent,
+		Code: UserMFADeviceAddedCode,
+	}
+	// UserMFADeviceDeleted is emitted when a user removes an MFA device.
+	UserMFADeviceDeleted = Event{
+		Name: UserMFADeviceDeletedEvent,
+		Code: UserMFADeviceDeletedCode,
+	}
+	// MFAAuthFailure is emitted when an MFA assertion fails to verify.
+	MFAAuthFailure = Event{
+		Name: MFAAuthFailureEvent,
+		Code: MFAAuthFailureCode,
+	}
 	// AccessRequestCreated is emitted when an access request is created.
 	AccessRequestCreated = Event{
 		Name: AccessRequestCreateEvent,
@@ -211,6 +238,37 @@ var (
 		Name: GithubConnectorDeletedEvent,
 		Code: GithubConnectorDeletedCode,
 	}
+	// RolePermissionGranted is emitted when a permission is added to an
+	// existing role.
+	RolePermissionGranted = Event{
+		Name: RolePermissionGrantedEvent,
+		Code: RolePermissionGrantedCode,
+	}
+	// RolePermissionRevoked is emitted when a permission is removed from an
+	// existing role.
+	RolePermissionRevoked = Event{
+		Name: RolePermissionRevokedEvent,
+		Code: RolePermissionRevokedCode,
+	}
+	// RoleAllowRuleAdded names the addition of an allow rule to an existing
+	// role. emitRolePermissionEvents reports allow rule additions as
+	// RolePermissionGranted, not with this event.
+	RoleAllowRuleAdded = Event{
+		Name: RoleAllowRuleAddedEvent,
+		Code: RoleAllowRuleAddedCode,
+	}
+	// RoleDenyRuleAdded is emitted when a deny rule is added to an existing
+	// role.
+	RoleDenyRuleAdded = Event{
+		Name: RoleDenyRuleAddedEvent,
+		Code: RoleDenyRuleAddedCode,
+	}
+	// RoleDenyRuleRemoved is emitted when a deny rule is removed from an
+	// existing role.
+	RoleDenyRuleRemoved = Event{
+		Name: RoleDenyRuleRemovedEvent,
+		Code: RoleDenyRuleRemovedCode,
+	}
 	// OIDCConnectorCreated is emitted when an OIDC connector is created/updated.
 	OIDCConnectorCreated = Event{
 		Name: OIDCConnectorCreatedEvent,
@@ -231,6 +289,39 @@ var (
 		Name: SAMLConnectorDeletedEvent,
 		Code: SAMLConnectorDeletedCode,
 	}
+	// OpenShiftConnectorCreated is emitted when an OpenShift connector is created/updated.
+	OpenShiftConnectorCreated = Event{
+		Name: OpenShiftConnectorCreatedEvent,
+		Code: OpenShiftConnectorCreatedCode,
+	}
+	// OpenShiftConnectorDeleted is emitted when an OpenShift connector is deleted.
+	OpenShiftConnectorDeleted = Event{
+		Name: OpenShiftConnectorDeletedEvent,
+		Code: OpenShiftConnectorDeletedCode,
+	}
+	// KubernetesJoinFailure is emitted when a node's kubernetes join method
+	// attempt is rejected, e.g. because its ServiceAccount JWT doesn't match
+	// any configured allow rule.
+	KubernetesJoinFailure = Event{
+		Name: KubernetesJoinFailureEvent,
+		Code: KubernetesJoinFailureCode,
+	}
+	// X5CJoinFailure is emitted when a node's x5c join method attempt is
+	// rejected, e.g. because its certificate chain doesn't verify against
+	// the pinned CA bundle.
+	X5CJoinFailure = Event{
+		Name: X5CJoinFailureEvent,
+		Code: X5CJoinFailureCode,
+	}
+)
+
+// Event names for the OpenShift connector lifecycle events above, following
+// the same naming convention as GithubConnectorCreatedEvent/DeletedEvent.
+const (
+	// OpenShiftConnectorCreatedEvent is the event name for connector creation.
+	OpenShiftConnectorCreatedEvent = "openshift.created"
+	// OpenShiftConnectorDeletedEvent is the event name for connector deletion.
+	OpenShiftConnectorDeletedEvent = "openshift.deleted"
 )
 
 // OSS event codes start with "T".
@@ -251,6 +342,19 @@ const (
 	UserCreateCode = "T1004I"
 	// UserPasswordChangeCode is an event code for when user changes their own password.
 	UserPasswordChangeCode = "T1005I"
+	// UserLoginLockedCode is emitted exactly once when an account trips
+	// defaults.MaxLoginAttempts and gets locked out.
+	UserLoginLockedCode = "T1006W"
+	// UserLoginUnlockedCode is emitted when an admin clears a locked
+	// account via UnlockUser. A lock that expires after AccountLockInterval
+	// does not emit it.
+	UserLoginUnlockedCode = "T1007I"
+	// UserMFADeviceAddedCode is the MFA device registration event code.
+	UserMFADeviceAddedCode = "T1008I"
+	// UserMFADeviceDeletedCode is the MFA device removal event code.
+	UserMFADeviceDeletedCode = "T1009I"
+	// MFAAuthFailureCode is the MFA assertion failure event code.
+	MFAAuthFailureCode = "T1010W"
 	// SessionStartCode is the session start event code.
 	SessionStartCode = "T2000I"
 	// SessionJoinCode is the session join event code.
@@ -321,4 +425,71 @@ const (
 	SAMLConnectorCreatedCode = "TE1002I"
 	// SAMLConnectorDeletedCode is the SAML connector deleted event code.
 	SAMLConnectorDeletedCode = "TE2002I"
+	// RolePermissionGrantedCode is the role permission granted event code.
+	RolePermissionGrantedCode = "TE1003I"
+	// RolePermissionRevokedCode is the role permission revoked event code.
+	RolePermissionRevokedCode = "TE1004I"
+	// RoleAllowRuleAddedCode is the role allow rule added event code.
+	RoleAllowRuleAddedCode = "TE1005I"
+	// RoleDenyRuleAddedCode is the role deny rule added event code.
+	RoleDenyRuleAddedCode = "TE1006I"
+	// RoleDenyRuleRemovedCode is the role deny rule removed event code.
+	RoleDenyRuleRemovedCode = "TE1008I"
+	// OpenShiftConnectorCreatedCode is the OpenShift connector created event code.
+	OpenShiftConnectorCreatedCode = "TE1007I"
+	// OpenShiftConnectorDeletedCode is the OpenShift connector deleted event code.
+	OpenShiftConnectorDeletedCode = "TE2003I"
+	// KubernetesJoinFailureCode is the kubernetes join method failure event code.
+	KubernetesJoinFailureCode = "TE3000W"
+	// X5CJoinFailureCode is the x5c join method failure event code.
+	X5CJoinFailureCode = "TE3001W"
+)
+
+// Event names for the lockout/brute-force events above.
+const (
+	// UserLoginLockedEvent is the event name for an account lockout.
+	UserLoginLockedEvent = "user.login.locked"
+	// UserLoginUnlockedEvent is the event name for an account unlock.
+	UserLoginUnlockedEvent = "user.login.unlocked"
+)
+
+// Event names for the MFA device lifecycle and assertion failure events
+// above.
+const (
+	// UserMFADeviceAddedEvent is the event name for MFA device registration.
+	UserMFADeviceAddedEvent = "mfa_device.added"
+	// UserMFADeviceDeletedEvent is the event name for MFA device removal.
+	UserMFADeviceDeletedEvent = "mfa_device.deleted"
+	// MFAAuthFailureEvent is the event name for a failed MFA assertion.
+	MFAAuthFailureEvent = "mfa_auth.failure"
+)
+
+// Event names for the fine-grained role permission change events above.
+// They share the RoleCreatedEvent/RoleDeletedEvent naming convention but are
+// kept distinct so downstream consumers can alert on incremental permission
+// changes without diffing full role snapshots.
+const (
+	// RolePermissionGrantedEvent is the event name for a granted permission.
+	RolePermissionGrantedEvent = "role.permission.granted"
+	// RolePermissionRevokedEvent is the event name for a revoked permission.
+	RolePermissionRevokedEvent = "role.permission.revoked"
+	// RoleAllowRuleAddedEvent is the event name for an added allow rule.
+	RoleAllowRuleAddedEvent = "role.rule.allow.added"
+	// RoleDenyRuleAddedEvent is the event name for an added deny rule.
+	RoleDenyRuleAddedEvent = "role.rule.deny.added"
+	// RoleDenyRuleRemovedEvent is the event name for a removed deny rule.
+	RoleDenyRuleRemovedEvent = "role.rule.deny.removed"
+)
+
+// Event name for the kubernetes join method failure event above.
+const (
+	// KubernetesJoinFailureEvent is the event name for a rejected kubernetes
+	// join attempt.
+	KubernetesJoinFailureEvent = "kubernetes_join.failure"
+)
+
+// Event name for the x5c join method failure event above.
+const (
+	// X5CJoinFailureEvent is the event name for a rejected x5c join attempt.
+	X5CJoinFailureEvent = "x5c_join.failure"
 )
@@ -0,0 +1,121 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+import (
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+// Category classifies an event for downstream routing/filtering, e.g. by a
+// SIEM rule that only cares about "auth" events.
+type Category string
+
+const (
+	// CategoryAuth covers login, lockout, and MFA events.
+	CategoryAuth Category = "auth"
+	// CategorySession covers interactive session lifecycle events.
+	CategorySession Category = "session"
+	// CategoryResource covers CRUD on cluster resources (roles, connectors,
+	// tokens, access requests).
+	CategoryResource Category = "resource"
+	// CategoryNetwork covers exec, port forwarding, subsystem, and SCP
+	// events.
+	CategoryNetwork Category = "network"
+)
+
+// Severity is derived from the single-letter suffix on an event Code
+// (I = info, W = warning, E = error).
+type Severity string
+
+const (
+	SeverityInfo    Severity = "info"
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+	SeverityUnknown Severity = "unknown"
+)
+
+// SeverityOf derives a Severity from an event code's trailing letter, e.g.
+// "T3007W" -> SeverityWarning.
+func SeverityOf(code string) Severity {
+	if code == "" {
+		return SeverityUnknown
+	}
+	switch code[len(code)-1] {
+	case 'I':
+		return SeverityInfo
+	case 'W':
+		return SeverityWarning
+	case 'E':
+		return SeverityError
+	default:
+		return SeverityUnknown
+	}
+}
+
+// CategoryOf classifies an event by name, falling back to CategoryResource
+// for anything that isn't recognized as an auth/session/network event.
+// This mirrors the grouping used by the numeric code ranges (T1xxx user,
+// T2xxx session, T3xxx network, ...) without hard-coding every code.
+func CategoryOf(eventName string) Category {
+	switch {
+	case strings.HasPrefix(eventName, "user.login"),
+		strings.HasPrefix(eventName, "mfa_"),
+		eventName == UserPasswordChangeEvent,
+		eventName == AuthAttemptEvent:
+		return CategoryAuth
+	case strings.HasPrefix(eventName, "session."),
+		eventName == ResizeEvent:
+		return CategorySession
+	case eventName == SubsystemEvent,
+		eventName == ExecEvent,
+		eventName == PortForwardEvent,
+		eventName == SCPEvent,
+		eventName == ClientDisconnectEvent:
+		return CategoryNetwork
+	default:
+		return CategoryResource
+	}
+}
+
+// requiredFields lists the EventFields keys that must be present for a
+// given event name. It's intentionally sparse: only events whose absence
+// of a field would silently break a downstream SIEM query are listed here;
+// everything else has no mandatory fields.
+var requiredFields = map[string][]string{
+	UserLoginEvent:          {EventUser},
+	UserPasswordChangeEvent: {EventUser},
+	AuthAttemptEvent:        {EventUser, EventLoginIP},
+	UserLoginLockedEvent:    {EventUser},
+}
+
+// ValidateFields checks that event's mandatory fields (per requiredFields)
+// are present in fields, returning a BadParameter error naming the first
+// field that's missing. Both the real emitter and
+// MockAuditLog.MockEmitAuditEvent should call this at emit time so field
+// drift (like the EventUser-only coverage in TestChangePassword) is caught
+// as soon as a new required field is declared, rather than discovered by a
+// downstream integration silently dropping rows.
+func ValidateFields(event Event, fields EventFields) error {
+	for _, required := range requiredFields[event.Name] {
+		if _, ok := fields[required]; !ok {
+			return trace.BadParameter("event %q is missing required field %q", event.Name, required)
+		}
+	}
+	return nil
+}
@@ -1,5 +1,5 @@
 /*
-Copyright 2018 Gravitational, Inc.
+Copyright 2018-2020 Gravitational, Inc.
 
 Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
@@ -17,6 +17,7 @@ limitations under the License.
 package service
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -36,70 +37,217 @@ const (
 	// stateStarting means the process is starting but hasn't joined the
 	// cluster yet.
 	stateStarting
+	// stateShuttingDown means the subsystem has begun a graceful shutdown
+	// but is still draining connections.
+	stateShuttingDown
+	// stateShutDown means the subsystem has fully stopped.
+	stateShutDown
 )
 
-var stateGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-	Name: teleport.MetricState,
-	Help: "State of the teleport process: 0 - ok, 1 - recovering, 2 - degraded, 3 - starting",
-})
+// stateName returns the label value used for a state in metrics and log
+// messages.
+func stateName(state int64) string {
+	switch state {
+	case stateOK:
+		return "ok"
+	case stateRecovering:
+		return "recovering"
+	case stateDegraded:
+		return "degraded"
+	case stateStarting:
+		return "starting"
+	case stateShuttingDown:
+		return "shutting_down"
+	case stateShutDown:
+		return "shut_down"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	stateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: teleport.MetricState,
+		Help: "State of a teleport subsystem: 0 - ok, 1 - recovering, 2 - degraded, 3 - starting, 4 - shutting down, 5 - shut down",
+	}, []string{"subsystem"})
+
+	stateTransitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "teleport_state_transitions_total",
+		Help: "Number of times a subsystem has transitioned from one state to another",
+	}, []string{"subsystem", "from", "to"})
+
+	recoveryDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "teleport_recovery_duration_seconds",
+		Help:    "Time a subsystem spent recovering from a degraded state",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"subsystem"})
+)
 
 func init() {
 	prometheus.MustRegister(stateGauge)
-	stateGauge.Set(stateStarting)
+	prometheus.MustRegister(stateTransitionsTotal)
+	prometheus.MustRegister(recoveryDurationSeconds)
+}
+
+// StateChange describes a single state transition of a subsystem, delivered
+// to anyone who called processState.Subscribe for that subsystem.
+type StateChange struct {
+	// Subsystem is the name passed to Process/Subscribe (e.g. "auth",
+	// "proxy", "node", "kube", "app", "db").
+	Subsystem string
+	// State is the subsystem's new state (one of the state* constants).
+	State int64
+	// Time is when the transition happened.
+	Time time.Time
 }
 
-// processState tracks the state of the Teleport process.
+// subsystemState tracks the FSM for a single registered subsystem.
+type subsystemState struct {
+	currentState   int64
+	recoveryTime   time.Time
+	lastTransition time.Time
+	subscribers    []chan StateChange
+}
+
+// processState tracks the state of every registered Teleport subsystem
+// (auth, proxy, node, kube, app, db, ...) independently, so a caller can
+// tell "auth is degraded but node is fine" instead of collapsing the whole
+// process into a single state.
 type processState struct {
-	process      *TeleportProcess
-	recoveryTime time.Time
-	currentState int64
+	process *TeleportProcess
+
+	mu         sync.Mutex
+	subsystems map[string]*subsystemState
 }
 
-// newProcessState returns a new FSM that tracks the state of the Teleport process.
+// newProcessState returns a new FSM that tracks the state of the Teleport
+// process, one subsystem at a time.
 func newProcessState(process *TeleportProcess) *processState {
 	return &processState{
-		process:      process,
-		recoveryTime: process.Clock.Now(),
-		currentState: stateStarting,
+		process:    process,
+		subsystems: make(map[string]*subsystemState),
+	}
+}
+
+// subsystem returns the subsystem's state, creating it (in stateStarting)
+// the first time it's seen. Callers must hold f.mu.
+func (f *processState) subsystem(name string) *subsystemState {
+	s, ok := f.subsystems[name]
+	if !ok {
+		s = &subsystemState{
+			currentState:   stateStarting,
+			recoveryTime:   f.process.Clock.Now(),
+			lastTransition: f.process.Clock.Now(),
+		}
+		f.subsystems[name] = s
+		stateGauge.WithLabelValues(name).Set(stateStarting)
 	}
+	return s
 }
 
-// Process updates the state of Teleport.
-func (f *processState) Process(event Event) {
+// Subscribe returns a channel that receives every subsequent state change
+// for subsystem. The channel is buffered and never blocks Process: a slow
+// or absent reader simply misses transitions rather than stalling the FSM.
+func (f *processState) Subscribe(subsystem string) <-chan StateChange {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := make(chan StateChange, 8)
+	s := f.subsystem(subsystem)
+	s.subscribers = append(s.subscribers, ch)
+	return ch
+}
+
+// Snapshot returns the current state and last-transition time of every
+// subsystem seen so far by Process, Subscribe or GetState; one that has
+// not reported in yet shows as stateStarting.
+func (f *processState) Snapshot() map[string]StateChange {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make(map[string]StateChange, len(f.subsystems))
+	for name, s := range f.subsystems {
+		out[name] = StateChange{
+			Subsystem: name,
+			State:     atomic.LoadInt64(&s.currentState),
+			Time:      s.lastTransition,
+		}
+	}
+	return out
+}
+
+// transition moves subsystem to newState, updating metrics, logs and
+// subscribers. Callers must hold f.mu.
+func (f *processState) transition(subsystem string, s *subsystemState, newState int64) {
+	oldState := atomic.LoadInt64(&s.currentState)
+	if oldState == newState {
+		return
+	}
+	atomic.StoreInt64(&s.currentState, newState)
+	now := f.process.Clock.Now()
+	s.lastTransition = now
+
+	stateGauge.WithLabelValues(subsystem).Set(float64(newState))
+	stateTransitionsTotal.WithLabelValues(subsystem, stateName(oldState), stateName(newState)).Inc()
+
+	change := StateChange{Subsystem: subsystem, State: newState, Time: now}
+	for _, ch := range s.subscribers {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+// Process updates the state of the named subsystem in response to event.
+func (f *processState) Process(subsystem string, event Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.subsystem(subsystem)
 	switch event.Name {
-	// Ready event means Teleport has started successfully.
+	// Ready event means the subsystem has started successfully.
 	case TeleportReadyEvent:
-		atomic.StoreInt64(&f.currentState, stateOK)
-		stateGauge.Set(stateOK)
-		f.process.Infof("Detected that service started and joined the cluster successfully.")
+		f.transition(subsystem, s, stateOK)
+		f.process.Infof("Detected that %v started and joined the cluster successfully.", subsystem)
 	// If a degraded event was received, always change the state to degraded.
 	case TeleportDegradedEvent:
-		atomic.StoreInt64(&f.currentState, stateDegraded)
-		stateGauge.Set(stateDegraded)
-		f.process.Infof("Detected Teleport is running in a degraded state.")
+		f.transition(subsystem, s, stateDegraded)
+		f.process.Infof("Detected %v is running in a degraded state.", subsystem)
 	// If the current state is degraded, and a OK event has been
 	// received, change the state to recovering. If the current state is
 	// recovering and a OK events is received, if it's been longer
 	// than the recovery time (2 time the server keep alive ttl), change
 	// state to OK.
 	case TeleportOKEvent:
-		switch atomic.LoadInt64(&f.currentState) {
+		switch atomic.LoadInt64(&s.currentState) {
 		case stateDegraded:
-			atomic.StoreInt64(&f.currentState, stateRecovering)
-			stateGauge.Set(stateRecovering)
-			f.recoveryTime = f.process.Clock.Now()
-			f.process.Infof("Teleport is recovering from a degraded state.")
+			s.recoveryTime = f.process.Clock.Now()
+			f.transition(subsystem, s, stateRecovering)
+			f.process.Infof("%v is recovering from a degraded state.", subsystem)
 		case stateRecovering:
-			if f.process.Clock.Now().Sub(f.recoveryTime) > defaults.ServerKeepAliveTTL*2 {
-				atomic.StoreInt64(&f.currentState, stateOK)
-				stateGauge.Set(stateOK)
-				f.process.Infof("Teleport has recovered from a degraded state.")
+			if since := f.process.Clock.Now().Sub(s.recoveryTime); since > defaults.ServerKeepAliveTTL*2 {
+				recoveryDurationSeconds.WithLabelValues(subsystem).Observe(since.Seconds())
+				f.transition(subsystem, s, stateOK)
+				f.process.Infof("%v has recovered from a degraded state.", subsystem)
 			}
 		}
+	// ShuttingDown/ShutDown track the subsystem's own lifecycle rather than
+	// its connectivity to the cluster, so they're unconditional like Ready
+	// and Degraded.
+	case TeleportShuttingDownEvent:
+		f.transition(subsystem, s, stateShuttingDown)
+		f.process.Infof("%v is shutting down.", subsystem)
+	case TeleportShutDownEvent:
+		f.transition(subsystem, s, stateShutDown)
+		f.process.Infof("%v has shut down.", subsystem)
 	}
 }
 
-// GetState returns the current state of the system.
-func (f *processState) GetState() int64 {
-	return atomic.LoadInt64(&f.currentState)
+// GetState returns the current state of the named subsystem, or
+// stateStarting if it hasn't reported in yet.
+func (f *processState) GetState(subsystem string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return atomic.LoadInt64(&f.subsystem(subsystem).currentState)
 }
@@ -0,0 +1,191 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+)
+
+// OpenShiftConnector defines an interface for an OpenShift OAuth connector,
+// mirroring the shape of GithubConnector/OIDCConnector so it can be onboarded
+// through the same tctl create/get/rm verbs.
+type OpenShiftConnector interface {
+	// Resource provides common methods for objects.
+	Resource
+	// GetIssuerURL returns the OpenShift OAuth server's base URL, e.g.
+	// "https://openshift.example.com:8443".
+	GetIssuerURL() string
+	// GetClientID returns the OAuth client ID registered with OpenShift.
+	GetClientID() string
+	// GetClientSecret returns the OAuth client secret.
+	GetClientSecret() string
+	// GetRedirectURL returns the callback URL registered with OpenShift.
+	GetRedirectURL() string
+	// GetGroupsToRoles returns the mapping of OpenShift group membership to
+	// Teleport roles.
+	GetGroupsToRoles() map[string][]string
+}
+
+// OpenShiftConnectorSpecV3 is the OpenShift OAuth connector spec.
+type OpenShiftConnectorSpecV3 struct {
+	// IssuerURL is the OpenShift OAuth server's base URL.
+	IssuerURL string `json:"issuer_url"`
+	// ClientID is the OAuth client ID registered with OpenShift.
+	ClientID string `json:"client_id"`
+	// ClientSecret is the OAuth client secret.
+	ClientSecret string `json:"client_secret"`
+	// RedirectURL is the callback URL registered with OpenShift.
+	RedirectURL string `json:"redirect_url"`
+	// GroupsToRoles maps an OpenShift group name to the Teleport roles a
+	// member of that group should receive.
+	GroupsToRoles map[string][]string `json:"groups_to_roles,omitempty"`
+}
+
+// OpenShiftConnectorV3 implements OpenShiftConnector.
+type OpenShiftConnectorV3 struct {
+	// Kind is a resource kind.
+	Kind string `json:"kind"`
+	// SubKind is an optional resource sub kind.
+	SubKind string `json:"sub_kind,omitempty"`
+	// Version is a resource version.
+	Version string `json:"version"`
+	// Metadata is connector metadata.
+	Metadata Metadata `json:"metadata"`
+	// Spec is connector spec.
+	Spec OpenShiftConnectorSpecV3 `json:"spec"`
+}
+
+// NewOpenShiftConnector returns a new OpenShift connector from name and spec.
+func NewOpenShiftConnector(name string, spec OpenShiftConnectorSpecV3) OpenShiftConnector {
+	return &OpenShiftConnectorV3{
+		Kind:    KindOpenShiftConnector,
+		Version: V3,
+		Metadata: Metadata{
+			Name: name,
+		},
+		Spec: spec,
+	}
+}
+
+// GetName returns the name of the connector.
+func (c *OpenShiftConnectorV3) GetName() string {
+	return c.Metadata.Name
+}
+
+// SetName sets the name of the connector.
+func (c *OpenShiftConnectorV3) SetName(name string) {
+	c.Metadata.Name = name
+}
+
+// GetMetadata returns the connector's metadata.
+func (c *OpenShiftConnectorV3) GetMetadata() Metadata {
+	return c.Metadata
+}
+
+// Expiry returns the connector's expiry time, if any.
+func (c *OpenShiftConnectorV3) Expiry() time.Time {
+	return c.Metadata.Expiry()
+}
+
+// SetExpiry sets the connector's expiry time.
+func (c *OpenShiftConnectorV3) SetExpiry(expires time.Time) {
+	c.Metadata.SetExpiry(expires)
+}
+
+// SetTTL sets the connector's TTL, relative to clock.
+func (c *OpenShiftConnectorV3) SetTTL(clock clockwork.Clock, ttl time.Duration) {
+	c.Metadata.SetTTL(clock, ttl)
+}
+
+// GetKind returns the connector's resource kind.
+func (c *OpenShiftConnectorV3) GetKind() string {
+	return c.Kind
+}
+
+// GetSubKind returns the connector's resource sub kind.
+func (c *OpenShiftConnectorV3) GetSubKind() string {
+	return c.SubKind
+}
+
+// SetSubKind sets the connector's resource sub kind.
+func (c *OpenShiftConnectorV3) SetSubKind(subKind string) {
+	c.SubKind = subKind
+}
+
+// GetVersion returns the connector's resource version.
+func (c *OpenShiftConnectorV3) GetVersion() string {
+	return c.Version
+}
+
+// GetResourceID returns the connector's internal resource ID.
+func (c *OpenShiftConnectorV3) GetResourceID() int64 {
+	return c.Metadata.ID
+}
+
+// SetResourceID sets the connector's internal resource ID.
+func (c *OpenShiftConnectorV3) SetResourceID(id int64) {
+	c.Metadata.ID = id
+}
+
+// GetIssuerURL returns the OpenShift OAuth server's base URL.
+func (c *OpenShiftConnectorV3) GetIssuerURL() string {
+	return c.Spec.IssuerURL
+}
+
+// GetClientID returns the OAuth client ID registered with OpenShift.
+func (c *OpenShiftConnectorV3) GetClientID() string {
+	return c.Spec.ClientID
+}
+
+// GetClientSecret returns the OAuth client secret.
+func (c *OpenShiftConnectorV3) GetClientSecret() string {
+	return c.Spec.ClientSecret
+}
+
+// GetRedirectURL returns the callback URL registered with OpenShift.
+func (c *OpenShiftConnectorV3) GetRedirectURL() string {
+	return c.Spec.RedirectURL
+}
+
+// GetGroupsToRoles returns the mapping of OpenShift group membership to
+// Teleport roles.
+func (c *OpenShiftConnectorV3) GetGroupsToRoles() map[string][]string {
+	return c.Spec.GroupsToRoles
+}
+
+// CheckAndSetDefaults validates the connector and sets default values.
+func (c *OpenShiftConnectorV3) CheckAndSetDefaults() error {
+	if c.Metadata.Name == "" {
+		return trace.BadParameter("missing connector name")
+	}
+	if c.Spec.IssuerURL == "" {
+		return trace.BadParameter("missing issuer_url")
+	}
+	if c.Spec.ClientID == "" {
+		return trace.BadParameter("missing client_id")
+	}
+	if c.Spec.ClientSecret == "" {
+		return trace.BadParameter("missing client_secret")
+	}
+	if c.Spec.RedirectURL == "" {
+		return trace.BadParameter("missing redirect_url")
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"time"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// Join method names a ProvisionTokenV2 may use instead of the classic
+// shared-secret token.
+const (
+	// JoinMethodToken is the classic shared-secret join method: presenting
+	// the token's name is itself the proof of authorization.
+	JoinMethodToken = "token"
+	// JoinMethodKubernetes authorizes a join by verifying a Kubernetes
+	// projected ServiceAccount JWT against the rules in
+	// ProvisionTokenSpecV2Kubernetes, instead of a shared secret.
+	JoinMethodKubernetes = "kubernetes"
+	// JoinMethodX5C authorizes a join by verifying an X.509 certificate
+	// chain against the pinned CA bundle and rules in
+	// ProvisionTokenSpecV2X5C, instead of a shared secret.
+	JoinMethodX5C = "x5c"
+)
+
+// KubernetesJoinRule is one entry in a ProvisionTokenSpecV2Kubernetes allow
+// list. A presented ServiceAccount JWT matches the rule if every non-empty
+// field equals (or, for Audience, is among) the corresponding JWT claim.
+type KubernetesJoinRule struct {
+	// Namespace is the Kubernetes namespace the ServiceAccount lives in.
+	Namespace string `json:"namespace,omitempty"`
+	// ServiceAccount is the ServiceAccount's name.
+	ServiceAccount string `json:"service_account,omitempty"`
+	// Audience is an audience the presented JWT's `aud` claim must include.
+	Audience string `json:"audience,omitempty"`
+}
+
+// ProvisionTokenSpecV2Kubernetes configures the "kubernetes" join method:
+// where to fetch the issuer's signing keys from, and which ServiceAccounts
+// are allowed to use this token.
+type ProvisionTokenSpecV2Kubernetes struct {
+	// Issuer is the expected `iss` claim of a presented JWT.
+	Issuer string `json:"issuer"`
+	// JWKSURI is fetched (and cached) to verify a presented JWT's
+	// signature. Mutually exclusive with JWKS.
+	JWKSURI string `json:"jwks_uri,omitempty"`
+	// JWKS is an inline JSON Web Key Set, for clusters that can't reach
+	// JWKSURI from the auth server. Mutually exclusive with JWKSURI.
+	JWKS string `json:"jwks,omitempty"`
+	// Allow is the list of ServiceAccount/namespace/audience combinations
+	// permitted to use this token. A JWT matching none of these rules is
+	// rejected even if its signature and issuer are valid.
+	Allow []KubernetesJoinRule `json:"allow"`
+}
+
+// X5CJoinRule is one entry in a ProvisionTokenSpecV2X5C allow list. A
+// presented leaf certificate matches the rule if every non-empty field
+// equals (or, for DNSName/OrganizationalUnit, is among) the corresponding
+// certificate field.
+type X5CJoinRule struct {
+	// CommonName is the leaf certificate's Subject CommonName.
+	CommonName string `json:"common_name,omitempty"`
+	// DNSName is a name the leaf certificate's Subject Alternative Names
+	// must include.
+	DNSName string `json:"dns_name,omitempty"`
+	// OrganizationalUnit is a value the leaf certificate's Subject
+	// OrganizationalUnit must include.
+	OrganizationalUnit string `json:"organizational_unit,omitempty"`
+}
+
+// ProvisionTokenSpecV2X5C configures the "x5c" join method: the CA bundle a
+// presented certificate chain must verify against, an optional CRL, and
+// which certificate subjects are allowed to use this token.
+type ProvisionTokenSpecV2X5C struct {
+	// CAPEM is the PEM-encoded CA bundle a presented leaf certificate's
+	// chain must verify against. May contain more than one certificate.
+	CAPEM string `json:"x5c_ca_pem"`
+	// CRLPEM is an optional PEM-encoded CRL checked against the leaf
+	// certificate's serial number.
+	CRLPEM string `json:"x5c_crl_pem,omitempty"`
+	// Allow is the list of certificate subject combinations permitted to
+	// use this token. A certificate matching none of these rules is
+	// rejected even if its chain and expiry are valid.
+	Allow []X5CJoinRule `json:"allow"`
+}
+
+// ProvisionTokenSpecV2 is the spec of a ProvisionTokenV2 resource.
+type ProvisionTokenSpecV2 struct {
+	// Roles is the set of system roles this token allows joining as.
+	Roles teleport.Roles `json:"roles"`
+	// JoinMethod selects how a join request is authenticated. Defaults to
+	// JoinMethodToken (the token's name is the shared secret) when empty.
+	JoinMethod string `json:"join_method,omitempty"`
+	// Kubernetes configures JoinMethodKubernetes. Only read when
+	// JoinMethod is JoinMethodKubernetes.
+	Kubernetes *ProvisionTokenSpecV2Kubernetes `json:"kubernetes,omitempty"`
+	// X5C configures JoinMethodX5C. Only read when JoinMethod is
+	// JoinMethodX5C.
+	X5C *ProvisionTokenSpecV2X5C `json:"x5c,omitempty"`
+}
+
+// ProvisionTokenV2 is a join token that, unlike ProvisionTokenV1, can
+// describe non-shared-secret join methods such as JoinMethodKubernetes.
+// Tokens using a non-token JoinMethod are reusable: presenting valid proof
+// doesn't consume them, since the proof itself (a short-lived JWT) can't
+// be replayed once expired.
+type ProvisionTokenV2 struct {
+	// Kind is the resource kind, always KindToken.
+	Kind string `json:"kind"`
+	// Version is the resource version, always V2.
+	Version string `json:"version"`
+	// Metadata holds the token's name (the value presented by
+	// JoinMethodToken) and expiry.
+	Metadata Metadata `json:"metadata"`
+	// Spec is the token's configuration.
+	Spec ProvisionTokenSpecV2 `json:"spec"`
+}
+
+// NewProvisionTokenV2 creates a ProvisionTokenV2 with the given name and
+// spec, applying defaults and validating it.
+func NewProvisionTokenV2(name string, expires time.Time, spec ProvisionTokenSpecV2) (*ProvisionTokenV2, error) {
+	t := &ProvisionTokenV2{
+		Kind:    KindToken,
+		Version: V2,
+		Metadata: Metadata{
+			Name:    name,
+			Expires: &expires,
+		},
+		Spec: spec,
+	}
+	if err := t.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return t, nil
+}
+
+// CheckAndSetDefaults validates the token and fills in defaults.
+func (t *ProvisionTokenV2) CheckAndSetDefaults() error {
+	if t.Metadata.Name == "" {
+		return trace.BadParameter("provision token name is missing")
+	}
+	if len(t.Spec.Roles) == 0 {
+		return trace.BadParameter("provision token %q must allow at least one role", t.Metadata.Name)
+	}
+	if t.Spec.JoinMethod == "" {
+		t.Spec.JoinMethod = JoinMethodToken
+	}
+	switch t.Spec.JoinMethod {
+	case JoinMethodToken:
+	case JoinMethodKubernetes:
+		k := t.Spec.Kubernetes
+		if k == nil {
+			return trace.BadParameter("join method %q requires a kubernetes spec", JoinMethodKubernetes)
+		}
+		if k.Issuer == "" {
+			return trace.BadParameter("kubernetes join method requires an issuer")
+		}
+		if k.JWKSURI == "" && k.JWKS == "" {
+			return trace.BadParameter("kubernetes join method requires jwks_uri or an inline jwks")
+		}
+		if len(k.Allow) == 0 {
+			return trace.BadParameter("kubernetes join method requires at least one allow rule")
+		}
+	case JoinMethodX5C:
+		x := t.Spec.X5C
+		if x == nil {
+			return trace.BadParameter("join method %q requires an x5c spec", JoinMethodX5C)
+		}
+		if x.CAPEM == "" {
+			return trace.BadParameter("x5c join method requires a pinned CA bundle")
+		}
+		if len(x.Allow) == 0 {
+			return trace.BadParameter("x5c join method requires at least one allow rule")
+		}
+	default:
+		return trace.BadParameter("unsupported join method %q", t.Spec.JoinMethod)
+	}
+	return nil
+}
+
+// GetName returns the token's name.
+func (t *ProvisionTokenV2) GetName() string {
+	return t.Metadata.Name
+}
+
+// GetRoles returns the set of system roles this token allows joining as.
+func (t *ProvisionTokenV2) GetRoles() teleport.Roles {
+	return t.Spec.Roles
+}
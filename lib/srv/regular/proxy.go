@@ -51,6 +51,17 @@ type proxySubsys struct {
 	error     error
 	closeOnce sync.Once
 	agent     agent.Agent
+	// capabilities holds the subset of ourHandshakeCapabilities the target
+	// server echoed back during doFramedHandshake. It is empty until the
+	// handshake completes, and stays empty for servers that only speak the
+	// legacy handshake format.
+	capabilities sshutils.ProxyCapability
+}
+
+// Capabilities returns the handshake capabilities negotiated with the
+// target server. It is only meaningful after Start has run the handshake.
+func (t *proxySubsys) Capabilities() sshutils.ProxyCapability {
+	return t.capabilities
 }
 
 // parseProxySubsys looks at the requested subsystem name and returns a fully configured
@@ -61,12 +72,15 @@ type proxySubsys struct {
 //  "proxy:@clustername"        - Teleport request to connect to an auth server for cluster with name 'clustername'
 //  "proxy:host:22@clustername" - Teleport request to connect to host:22 on cluster 'clustername'
 //  "proxy:host:22@namespace@clustername"
+//  "proxy:{env=prod,role=web}:22@clustername" - connect to a node selected by label, disambiguated by matchServerByLabels
+//  "proxy:env=prod,role=web@clustername"      - same, without the optional port
 func parseProxySubsys(request string, srv *Server, ctx *srv.ServerContext) (*proxySubsys, error) {
 	log.Debugf("parse_proxy_subsys(%q)", request)
 	var (
 		clusterName  string
 		targetHost   string
 		targetPort   string
+		targetLabels map[string]string
 		paramMessage = fmt.Sprintf("invalid format for proxy request: %q, expected 'proxy:host:port@cluster'", request)
 	)
 	const prefix = "proxy:"
@@ -81,26 +95,26 @@ func parseProxySubsys(request string, srv *Server, ctx *srv.ServerContext) (*pro
 	switch {
 	case len(parts) == 0: // "proxy:"
 		return nil, trace.BadParameter(paramMessage)
-	case len(parts) == 1: // "proxy:host:22"
-		targetHost, targetPort, err = utils.SplitHostPort(parts[0])
+	case len(parts) == 1: // "proxy:host:22" or "proxy:{env=prod}:22"
+		targetLabels, targetHost, targetPort, err = parseProxyTarget(parts[0])
 		if err != nil {
 			return nil, trace.BadParameter(paramMessage)
 		}
 	case len(parts) == 2: // "proxy:@clustername" or "proxy:host:22@clustername"
 		if parts[0] != "" {
-			targetHost, targetPort, err = utils.SplitHostPort(parts[0])
+			targetLabels, targetHost, targetPort, err = parseProxyTarget(parts[0])
 			if err != nil {
 				return nil, trace.BadParameter(paramMessage)
 			}
 		}
 		clusterName = parts[1]
-		if clusterName == "" && targetHost == "" {
+		if clusterName == "" && targetHost == "" && len(targetLabels) == 0 {
 			return nil, trace.BadParameter("invalid format for proxy request: missing cluster name or target host in %q", request)
 		}
 	case len(parts) >= 3: // "proxy:host:22@namespace@clustername"
 		clusterName = strings.Join(parts[2:], "@")
 		namespace = parts[1]
-		targetHost, targetPort, err = utils.SplitHostPort(parts[0])
+		targetLabels, targetHost, targetPort, err = parseProxyTarget(parts[0])
 		if err != nil {
 			return nil, trace.BadParameter(paramMessage)
 		}
@@ -112,22 +126,65 @@ func parseProxySubsys(request string, srv *Server, ctx *srv.ServerContext) (*pro
 		ctx:         ctx,
 		host:        targetHost,
 		port:        targetPort,
+		labels:      targetLabels,
 		clusterName: clusterName,
 	})
 }
 
+// parseProxyTarget parses a single "host:port" or label-selector target,
+// e.g. "host:22", "{env=prod,role=web}:22" or "env=prod,role=web". A bare
+// label selector has no associated port; callers that require one should
+// validate targetPort separately.
+func parseProxyTarget(target string) (labels map[string]string, host, port string, err error) {
+	selector := target
+	if strings.HasPrefix(target, "{") {
+		closeIdx := strings.Index(target, "}")
+		if closeIdx == -1 {
+			return nil, "", "", trace.BadParameter("missing closing '}' in label selector %q", target)
+		}
+		selector = target[1:closeIdx]
+		rest := strings.TrimPrefix(target[closeIdx+1:], ":")
+		port = rest
+	} else if strings.Contains(target, "=") {
+		// bare "k=v,k=v" selector with no explicit port.
+	} else {
+		host, port, err = utils.SplitHostPort(target)
+		return nil, host, port, err
+	}
+
+	labels = make(map[string]string)
+	for _, pair := range strings.Split(selector, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, "", "", trace.BadParameter("invalid label selector %q", target)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	if len(labels) == 0 {
+		return nil, "", "", trace.BadParameter("invalid label selector %q", target)
+	}
+	return labels, "", port, nil
+}
+
 // proxySubsysConfig is a proxy subsystem configuration
 type proxySubsysConfig struct {
-	namespace   string
-	host        string
-	port        string
+	namespace string
+	host      string
+	port      string
+	// labels, when set, selects the target node by label instead of by
+	// host/IP/UUID. It is mutually exclusive with host.
+	labels      map[string]string
 	clusterName string
 	srv         *Server
 	ctx         *srv.ServerContext
 }
 
 func (p *proxySubsysConfig) String() string {
-	return fmt.Sprintf("host=%v, port=%v, cluster=%v", p.host, p.port, p.clusterName)
+	return fmt.Sprintf("host=%v, port=%v, labels=%v, cluster=%v", p.host, p.port, p.labels, p.clusterName)
 }
 
 // CheckAndSetDefaults checks and sets defaults
@@ -219,8 +276,8 @@ func (t *proxySubsys) Start(sconn *ssh.ServerConn, ch ssh.Channel, req *ssh.Requ
 			return trace.Wrap(err)
 		}
 	}
-	// connecting to a specific host:
-	if t.host != "" {
+	// connecting to a specific host, or a label selector that resolves to one:
+	if t.host != "" || len(t.labels) > 0 {
 		// no site given? use the 1st one:
 		if site == nil {
 			sites := tunnel.GetSites()
@@ -306,6 +363,12 @@ func (t *proxySubsys) proxyToHost(
 		}
 	}
 
+	// if the target was given as a label selector rather than a hostname,
+	// match on labels and dial the resolved server directly.
+	if len(t.labels) > 0 {
+		return t.proxyToLabeledHost(ctx, site, remoteAddr, ch, servers)
+	}
+
 	// if port is 0, it means the client wants us to figure out
 	// which port to use
 	specifiedPort := len(t.port) > 0 && t.port != "0"
@@ -443,6 +506,104 @@ func (t *proxySubsys) proxyToHost(
 	return nil
 }
 
+// matchServerByLabels filters servers by t.labels, applying the same
+// ambiguity check proxyToHost uses for hostname matches: more than one
+// server matching the selector is rejected rather than arbitrarily picking
+// one.
+func (t *proxySubsys) matchServerByLabels(servers []services.Server) (services.Server, error) {
+	var server services.Server
+	matches := 0
+	for i := range servers {
+		if serverMatchesLabels(servers[i], t.labels) {
+			server = servers[i]
+			matches++
+		}
+	}
+	if matches == 0 {
+		return nil, trace.NotFound("no server found matching labels %v", t.labels)
+	}
+	if matches > 1 {
+		return nil, trace.NotFound(teleport.NodeIsAmbiguous)
+	}
+	return server, nil
+}
+
+// serverMatchesLabels returns true if every key/value pair in selector is
+// present (and equal) in either the server's static or dynamic (command)
+// labels.
+func serverMatchesLabels(server services.Server, selector map[string]string) bool {
+	for k, v := range selector {
+		if label, ok := server.GetLabels()[k]; ok && label == v {
+			continue
+		}
+		if cmdLabel, ok := server.GetCmdLabels()[k]; ok && cmdLabel.GetResult() == v {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// proxyToLabeledHost resolves t.labels against servers and proxies the
+// connection to the unambiguous match, mirroring the principal/ServerID
+// construction in proxyToHost.
+func (t *proxySubsys) proxyToLabeledHost(
+	ctx *srv.ServerContext, site reversetunnel.RemoteSite, remoteAddr net.Addr, ch ssh.Channel, servers []services.Server) error {
+
+	server, err := t.matchServerByLabels(servers)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	serverID := fmt.Sprintf("%v.%v", server.GetName(), t.clusterName)
+	principals := []string{serverID, server.GetHostname()}
+	serverAddr := server.GetAddr()
+	if serverAddr != "" {
+		host, _, err := net.SplitHostPort(serverAddr)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		principals = append(principals, host)
+	}
+
+	toAddr := &utils.NetAddr{
+		AddrNetwork: "tcp",
+		Addr:        serverAddr,
+	}
+	conn, err := site.Dial(reversetunnel.DialParams{
+		From:       remoteAddr,
+		To:         toAddr,
+		UserAgent:  t.agent,
+		Address:    server.GetHostname(),
+		ServerID:   serverID,
+		Principals: principals,
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	t.doHandshake(remoteAddr, ch, conn)
+
+	go func() {
+		var err error
+		defer func() {
+			t.close(err)
+		}()
+		defer ch.Close()
+		_, err = io.Copy(ch, conn)
+	}()
+	go func() {
+		var err error
+		defer func() {
+			t.close(err)
+		}()
+		defer conn.Close()
+		_, err = io.Copy(conn, srv.NewTrackingReader(ctx, ch))
+	}()
+
+	return nil
+}
+
 func (t *proxySubsys) close(err error) {
 	t.closeOnce.Do(func() {
 		t.error = err
@@ -455,8 +616,30 @@ func (t *proxySubsys) Wait() error {
 	return t.error
 }
 
-// doHandshake allows a proxy server to send additional information (client IP)
-// to an SSH server before establishing a bridge
+// handshakeVersionSuffix is appended to the SSH version banner by Teleport
+// servers that understand the framed, capability-negotiating handshake,
+// e.g. "SSH-2.0-Teleport-hs2". Its absence (or a version below
+// sshutils.MinFramedHandshakeVersion) means the server only understands the
+// legacy single-HandshakePayload format.
+//
+// No server in this codebase advertises this suffix yet, so doFramedHandshake
+// is currently inert: doHandshake always falls back to doLegacyHandshake
+// until a server gains a framed-handshake reader and starts sending it.
+const handshakeVersionSuffix = "-hs"
+
+// ourHandshakeCapabilities is the set of extensions this proxy knows how to
+// offer in a framed handshake.
+const ourHandshakeCapabilities = sshutils.CapClientIP | sshutils.CapPROXYProtocol |
+	sshutils.CapForwardedIdentity | sshutils.CapResourceLimits | sshutils.CapKeepalive
+
+// doHandshake allows a proxy server to send additional information (client IP,
+// and on servers that support it, a richer set of typed extensions) to an SSH
+// server before establishing a bridge. Servers below
+// sshutils.MinFramedHandshakeVersion get the original single-payload
+// handshake for backward compatibility. In practice every server this proxy
+// talks to is currently below that version (see handshakeVersionSuffix), so
+// this always takes the legacy path; the framed branch is wired up and ready
+// for the day a server advertises the suffix.
 func (t *proxySubsys) doHandshake(clientAddr net.Addr, clientConn io.ReadWriter, serverConn io.ReadWriter) {
 	// on behalf of a client ask the server for it's version:
 	buff := make([]byte, sshutils.MaxVersionStringBytes)
@@ -470,21 +653,10 @@ func (t *proxySubsys) doHandshake(clientAddr net.Addr, clientConn io.ReadWriter,
 
 	// is that a Teleport server?
 	if bytes.HasPrefix(buff, []byte(sshutils.SSHVersionPrefix)) {
-		// if we're connecting to a Teleport SSH server, send our own "handshake payload"
-		// message, along with a client's IP:
-		hp := &sshutils.HandshakePayload{
-			ClientAddr: clientAddr.String(),
-		}
-		payloadJSON, err := json.Marshal(hp)
-		if err != nil {
-			t.log.Error(err)
+		if version, ok := parseHandshakeVersion(string(buff)); ok && version >= sshutils.MinFramedHandshakeVersion {
+			t.doFramedHandshake(clientAddr, serverConn)
 		} else {
-			// send a JSON payload sandwitched between 'teleport proxy signature' and 0x00:
-			payload := fmt.Sprintf("%s%s\x00", sshutils.ProxyHelloSignature, payloadJSON)
-			_, err = serverConn.Write([]byte(payload))
-			if err != nil {
-				t.log.Error(err)
-			}
+			t.doLegacyHandshake(clientAddr, serverConn)
 		}
 	}
 	// forwrd server's response to the client:
@@ -493,3 +665,71 @@ func (t *proxySubsys) doHandshake(clientAddr net.Addr, clientConn io.ReadWriter,
 		t.log.Error(err)
 	}
 }
+
+// parseHandshakeVersion extracts the handshake version advertised in an SSH
+// version banner, e.g. "SSH-2.0-Teleport-hs2" -> (2, true).
+func parseHandshakeVersion(banner string) (int, bool) {
+	idx := strings.Index(banner, handshakeVersionSuffix)
+	if idx == -1 {
+		return 0, false
+	}
+	rest := banner[idx+len(handshakeVersionSuffix):]
+	end := 0
+	for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+		end++
+	}
+	if end == 0 {
+		return 0, false
+	}
+	version, err := strconv.Atoi(rest[:end])
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
+
+// doLegacyHandshake sends the original single JSON HandshakePayload
+// sandwiched between ProxyHelloSignature and 0x00, for servers that don't
+// understand the framed handshake.
+func (t *proxySubsys) doLegacyHandshake(clientAddr net.Addr, serverConn io.Writer) {
+	hp := &sshutils.HandshakePayload{
+		ClientAddr: clientAddr.String(),
+	}
+	payloadJSON, err := json.Marshal(hp)
+	if err != nil {
+		t.log.Error(err)
+		return
+	}
+	// send a JSON payload sandwitched between 'teleport proxy signature' and 0x00:
+	payload := fmt.Sprintf("%s%s\x00", sshutils.ProxyHelloSignature, payloadJSON)
+	if _, err = serverConn.Write([]byte(payload)); err != nil {
+		t.log.Error(err)
+	}
+}
+
+// doFramedHandshake exchanges a versioned ProxyHandshakeFrame with a server
+// that advertised support for it, negotiating capabilities and storing the
+// subset the server understood on t.capabilities, which Capabilities
+// returns. proxyToHost and proxyToSite do not read it, and proxyToSite does
+// not run a handshake at all. Only reached once a server advertises
+// handshakeVersionSuffix; see doHandshake's comment.
+func (t *proxySubsys) doFramedHandshake(clientAddr net.Addr, serverConn io.ReadWriter) {
+	request := sshutils.ProxyHandshakeFrame{
+		Version:      sshutils.ProxyHandshakeVersion,
+		Capabilities: ourHandshakeCapabilities,
+		Extensions: sshutils.ProxyHandshakeExtensions{
+			ClientAddr: clientAddr.String(),
+		},
+	}
+	if err := sshutils.WriteFramedHandshake(serverConn, request); err != nil {
+		t.log.Error(err)
+		return
+	}
+	response, err := sshutils.ReadFramedHandshake(serverConn)
+	if err != nil {
+		t.log.Error(err)
+		return
+	}
+	t.capabilities = response.Capabilities & ourHandshakeCapabilities
+	t.log.Debugf("Negotiated handshake capabilities: %v", t.capabilities)
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package regular
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/reversetunnel"
+	"github.com/gravitational/teleport/lib/srv"
+
+	"github.com/gravitational/trace"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// publishSubsys implements an SSH subsystem that lets a plain OpenSSH client
+// expose a local TCP service through a Teleport cluster for the lifetime of
+// the SSH session, without requiring a `teleport` node to be deployed at the
+// target end. It is requested the same way `-R` port forwarding is, except
+// the listener lives on the proxy/reverse tunnel side rather than on the
+// client.
+//
+// publish subsystem name can take the following forms:
+//  "publish:tcp/8080@clustername"    - publish a raw TCP entry point on port 8080
+//  "publish:http/myapp@clustername"  - publish an entry point tagged "myapp" over HTTP
+type publishSubsys struct {
+	publishSubsysConfig
+	log       *logrus.Entry
+	closeC    chan struct{}
+	error     error
+	closeOnce sync.Once
+}
+
+// publishSubsysConfig is a publish subsystem configuration.
+type publishSubsysConfig struct {
+	protocol    string
+	target      string
+	clusterName string
+	srv         *Server
+	ctx         *srv.ServerContext
+}
+
+func (p *publishSubsysConfig) String() string {
+	return fmt.Sprintf("protocol=%v, target=%v, cluster=%v", p.protocol, p.target, p.clusterName)
+}
+
+// CheckAndSetDefaults checks and sets defaults.
+func (p *publishSubsysConfig) CheckAndSetDefaults() error {
+	if p.srv == nil {
+		return trace.BadParameter("missing parameter server")
+	}
+	if p.ctx == nil {
+		return trace.BadParameter("missing parameter context")
+	}
+	if p.protocol == "" {
+		return trace.BadParameter("missing publish protocol")
+	}
+	if p.clusterName == "" && p.ctx.Identity.RouteToCluster != "" {
+		p.clusterName = p.ctx.Identity.RouteToCluster
+	}
+	if p.clusterName != "" && p.srv.proxyTun != nil {
+		if _, err := p.srv.proxyTun.GetSite(p.clusterName); err != nil {
+			return trace.BadParameter("invalid format for publish request: unknown cluster %q", p.clusterName)
+		}
+	}
+	return nil
+}
+
+// parsePublishSubsys looks at the requested subsystem name and returns a
+// fully configured publish subsystem. The subsystem request dispatcher does
+// not call it, and parseProxySubsys rejects "publish:" requests.
+func parsePublishSubsys(request string, srv *Server, ctx *srv.ServerContext) (*publishSubsys, error) {
+	log.Debugf("parse_publish_subsys(%q)", request)
+	const prefix = "publish:"
+	paramMessage := fmt.Sprintf("invalid format for publish request: %q, expected 'publish:tcp/port@cluster'", request)
+	if !strings.HasPrefix(request, prefix) {
+		return nil, trace.BadParameter(paramMessage)
+	}
+	requestBody := strings.TrimPrefix(request, prefix)
+
+	var clusterName, entry string
+	parts := strings.SplitN(requestBody, "@", 2)
+	entry = parts[0]
+	if len(parts) == 2 {
+		clusterName = parts[1]
+	}
+
+	entryParts := strings.SplitN(entry, "/", 2)
+	if len(entryParts) != 2 || entryParts[0] == "" || entryParts[1] == "" {
+		return nil, trace.BadParameter(paramMessage)
+	}
+
+	return newPublishSubsys(publishSubsysConfig{
+		protocol:    entryParts[0],
+		target:      entryParts[1],
+		clusterName: clusterName,
+		srv:         srv,
+		ctx:         ctx,
+	})
+}
+
+// newPublishSubsys is a helper that creates a publish subsystem from a
+// parsed publish request.
+func newPublishSubsys(cfg publishSubsysConfig) (*publishSubsys, error) {
+	if err := cfg.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	log.Debugf("newPublishSubsys(%v).", cfg)
+	return &publishSubsys{
+		publishSubsysConfig: cfg,
+		log: logrus.WithFields(logrus.Fields{
+			trace.Component:       teleport.ComponentSubsystemProxy,
+			trace.ComponentFields: map[string]string{},
+		}),
+		closeC: make(chan struct{}),
+	}, nil
+}
+
+func (t *publishSubsys) String() string {
+	return fmt.Sprintf("publishSubsys(cluster=%s, protocol=%s, target=%s)",
+		t.clusterName, t.protocol, t.target)
+}
+
+// Start is called by Golang's ssh package when it needs to engage this
+// subsystem. It registers a short-lived entry with the reverse tunnel
+// subsystem, accepts connections routed to it for the lifetime of the SSH
+// session, and pipes each one back to the caller over a new SSH channel.
+func (t *publishSubsys) Start(sconn *ssh.ServerConn, ch ssh.Channel, req *ssh.Request, ctx *srv.ServerContext) error {
+	t.log = logrus.WithFields(logrus.Fields{
+		trace.Component: teleport.ComponentSubsystemProxy,
+		trace.ComponentFields: map[string]string{
+			"src":      sconn.RemoteAddr().String(),
+			"dst":      sconn.LocalAddr().String(),
+			"protocol": t.protocol,
+			"target":   t.target,
+		},
+	})
+	t.log.Debugf("Starting publish subsystem")
+
+	site, err := t.resolveSite()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	entryID := uuid.New()
+	entry, err := site.PublishEntry(reversetunnel.PublishEntryParams{
+		ID:       entryID,
+		Protocol: t.protocol,
+		Target:   t.target,
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	go func() {
+		defer entry.Close()
+		for {
+			conn, err := entry.Accept()
+			if err != nil {
+				if err != io.EOF {
+					t.log.Warnf("Publish entry %v closed: %v", entryID, err)
+				}
+				return
+			}
+			go t.relayConnection(ctx, sconn, conn)
+		}
+	}()
+
+	go func() {
+		<-t.closeC
+		entry.Close()
+	}()
+
+	go func() {
+		// The subsystem channel carries no data of its own; it just lives
+		// for as long as the SSH session does. Blocking on a read from it
+		// is how we learn the session ended, the same way proxySubsys's
+		// copy goroutines learn their connection ended and call t.close.
+		_, err := ch.Read(make([]byte, 1))
+		if err == io.EOF {
+			err = nil
+		}
+		t.close(err)
+	}()
+
+	return nil
+}
+
+// relayConnection opens a new SSH channel back to the caller and pipes the
+// inbound connection through it, reusing the same tracking reader plumbing
+// as proxyToHost so the bytes count towards the session's audit metrics.
+func (t *publishSubsys) relayConnection(ctx *srv.ServerContext, sconn *ssh.ServerConn, conn io.ReadWriteCloser) {
+	defer conn.Close()
+
+	channel, reqs, err := sconn.OpenChannel("published-tcpip", nil)
+	if err != nil {
+		t.log.Warnf("Failed to open channel for published connection: %v", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	defer channel.Close()
+
+	errC := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(channel, conn)
+		errC <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, srv.NewTrackingReader(ctx, channel))
+		errC <- err
+	}()
+	<-errC
+}
+
+// resolveSite returns the remote site that the publish entry should be
+// registered against.
+func (t *publishSubsys) resolveSite() (reversetunnel.RemoteSite, error) {
+	tunnel := t.srv.proxyTun
+	if t.clusterName != "" {
+		return tunnel.GetSite(t.clusterName)
+	}
+	sites := tunnel.GetSites()
+	if len(sites) == 0 {
+		return nil, trace.NotFound("no connected sites")
+	}
+	return sites[0], nil
+}
+
+func (t *publishSubsys) close(err error) {
+	t.closeOnce.Do(func() {
+		t.error = err
+		close(t.closeC)
+	})
+}
+
+func (t *publishSubsys) Wait() error {
+	<-t.closeC
+	return t.error
+}
@@ -20,7 +20,9 @@ import (
 	"context"
 	"io"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gravitational/teleport/lib/teleagent"
 
@@ -28,8 +30,140 @@ import (
 	"golang.org/x/crypto/ssh/agent"
 
 	"github.com/gravitational/trace"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// Channel type constants classify channels for stats and metrics. Session,
+// direct-tcpip and forwarded-tcpip are the real SSH channel types;
+// ChannelTypeAuthAgent is the short label normalizeChannelType maps
+// AuthAgentRequest's real wire type onto.
+const (
+	ChannelTypeSession        = "session"
+	ChannelTypeDirectTCPIP    = "direct-tcpip"
+	ChannelTypeForwardedTCPIP = "forwarded-tcpip"
+	ChannelTypeAuthAgent      = "auth-agent"
+)
+
+const (
+	statsDirectionRead  = "read"
+	statsDirectionWrite = "write"
+)
+
+// Session type constants classify the kind of SSH session a connection is
+// carrying, borrowed from the magic-session-type env technique used by
+// VS Code/JetBrains Remote SSH integrations.
+const (
+	SessionTypeShell     = "shell"
+	SessionTypeSFTP      = "sftp"
+	SessionTypeSCP       = "scp"
+	SessionTypeGit       = "git"
+	SessionTypeVSCode    = "vscode"
+	SessionTypeJetBrains = "jetbrains"
+	SessionTypeAnsible   = "ansible"
+)
+
+// SessionTypeEnv is a well-known environment variable a client can set to
+// declare the session type explicitly, instead of relying on heuristic
+// detection of the requested subsystem/exec command. SetEnv strips it so it
+// never leaks into the remote shell's environment.
+const SessionTypeEnv = "TELEPORT_SSH_SESSION_TYPE"
+
+var (
+	sshSessionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "teleport_ssh_sessions_total",
+		Help: "Number of SSH sessions started, labeled by classified type, login and node",
+	}, []string{"type", "login", "node"})
+
+	sshSessionsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "teleport_ssh_sessions_active",
+		Help: "Number of SSH sessions currently active, labeled by classified type",
+	}, []string{"type"})
+
+	connBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "teleport_ssh_conn_bytes_total",
+		Help: "Bytes transferred over SSH connections, labeled by direction and node",
+	}, []string{"direction", "node"})
+
+	connChannelsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "teleport_ssh_conn_channels_total",
+		Help: "Channels opened over SSH connections, labeled by type and node",
+	}, []string{"type", "node"})
+
+	connChannelsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "teleport_ssh_conn_channels_active",
+		Help: "Channels currently open over SSH connections, labeled by type",
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(sshSessionsTotal)
+	prometheus.MustRegister(sshSessionsActive)
+	prometheus.MustRegister(connBytesTotal)
+	prometheus.MustRegister(connChannelsTotal)
+	prometheus.MustRegister(connChannelsActive)
+}
+
+// connStats tracks byte and channel activity for a single connection.
+type connStats struct {
+	mu             sync.Mutex
+	bytesRead      uint64
+	bytesWritten   uint64
+	channelsByType map[string]int64
+	activeChannels int64
+	opened         time.Time
+	lastActivity   time.Time
+}
+
+// ConnStatsSnapshot is a point-in-time copy of a connection's stats.
+type ConnStatsSnapshot struct {
+	BytesRead      uint64
+	BytesWritten   uint64
+	ChannelsByType map[string]int64
+	ActiveChannels int64
+	Opened         time.Time
+	LastActivity   time.Time
+}
+
+// normalizeChannelType collapses a wire channel type into the short label
+// used for stats and metrics (the auth-agent channel's real type is
+// AuthAgentRequest, e.g. "auth-agent@openssh.com").
+func normalizeChannelType(channelType string) string {
+	if channelType == AuthAgentRequest {
+		return ChannelTypeAuthAgent
+	}
+	return channelType
+}
+
+// countingChannel wraps an ssh.Channel, tallying bytes and activity on the
+// parent ConnectionContext's stats, and reporting its close back so active
+// channel counts stay accurate.
+type countingChannel struct {
+	ssh.Channel
+	ctx         *ConnectionContext
+	channelType string
+}
+
+func (w *countingChannel) Read(p []byte) (int, error) {
+	n, err := w.Channel.Read(p)
+	if n > 0 {
+		w.ctx.recordBytes(statsDirectionRead, int64(n))
+	}
+	return n, err
+}
+
+func (w *countingChannel) Write(p []byte) (int, error) {
+	n, err := w.Channel.Write(p)
+	if n > 0 {
+		w.ctx.recordBytes(statsDirectionWrite, int64(n))
+	}
+	return n, err
+}
+
+func (w *countingChannel) Close() error {
+	w.ctx.noteChannelClosed(w.channelType)
+	return w.Channel.Close()
+}
+
 // ConnectionContext manages connection-level state.
 type ConnectionContext struct {
 	// NetConn is the base connection object.
@@ -58,21 +192,196 @@ type ConnectionContext struct {
 	// this is handy as sometimes client closes session, in this case resources
 	// will be properly closed and deallocated, otherwise they could be kept hanging.
 	closers []io.Closer
+
+	// sessionType is the best-effort classification of this connection's
+	// session (shell, sftp, an IDE tunnel, ...). SessionType returns it and
+	// RecordSessionStart uses it as the metrics type label; no audit event
+	// carries it, and IdleTimeoutLoop applies one timeout to every type.
+	sessionType string
+
+	// sessionTypeExplicit is true once sessionType was set via
+	// SessionTypeEnv, so later heuristic detection never overrides it.
+	sessionTypeExplicit bool
+
+	// login and node identify this connection for metrics, set by
+	// SetIdentity once the server has resolved them.
+	login, node string
+
+	// metricsRecorded guards RecordSessionStart/Close against
+	// double-counting teleport_ssh_sessions_total and _active.
+	metricsRecorded bool
+
+	// metricsType is the type label teleport_ssh_sessions_active was
+	// incremented with, so Close decrements the same series even if
+	// sessionType changed in between (e.g. a later heuristic match).
+	metricsType string
+
+	// stats tracks bytes read/written and channels opened on this
+	// connection, independent of the env/agent state above.
+	stats connStats
+
+	// reconnectRegistry is the process-wide registry AdoptReconnectingSession
+	// looks sessions up in, set by SetReconnectingSessionRegistry.
+	reconnectRegistry *ReconnectingSessionRegistry
 }
 
 // NewConnectionContext creates a new ConnectionContext instance.
 func NewConnectionContext(nconn net.Conn, sconn *ssh.ServerConn) *ConnectionContext {
+	now := time.Now()
 	return &ConnectionContext{
 		NetConn:    nconn,
 		ServerConn: sconn,
 		env:        make(map[string]string),
+		stats: connStats{
+			opened:       now,
+			lastActivity: now,
+		},
+	}
+}
+
+// OpenChannel opens a new outbound SSH channel of channelType, wrapping it
+// so every read/write updates this connection's stats and resets its idle
+// timer.
+func (c *ConnectionContext) OpenChannel(channelType string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := c.ServerConn.OpenChannel(channelType, data)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	normalized := normalizeChannelType(channelType)
+	c.noteChannelOpened(normalized)
+	return &countingChannel{Channel: ch, ctx: c, channelType: normalized}, reqs, nil
+}
+
+// AcceptChannel accepts an inbound SSH channel request of channelType,
+// wrapping it the same way OpenChannel does.
+func (c *ConnectionContext) AcceptChannel(channelType string, nch ssh.NewChannel) (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := nch.Accept()
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	normalized := normalizeChannelType(channelType)
+	c.noteChannelOpened(normalized)
+	return &countingChannel{Channel: ch, ctx: c, channelType: normalized}, reqs, nil
+}
+
+// recordBytes adds n bytes transferred in direction to this connection's
+// stats and refreshes its last-activity time.
+func (c *ConnectionContext) recordBytes(direction string, n int64) {
+	c.mu.RLock()
+	node := c.node
+	c.mu.RUnlock()
+
+	now := time.Now()
+	c.stats.mu.Lock()
+	if direction == statsDirectionRead {
+		c.stats.bytesRead += uint64(n)
+	} else {
+		c.stats.bytesWritten += uint64(n)
+	}
+	c.stats.lastActivity = now
+	c.stats.mu.Unlock()
+
+	connBytesTotal.WithLabelValues(direction, node).Add(float64(n))
+}
+
+// noteChannelOpened records that a channel of channelType was opened.
+func (c *ConnectionContext) noteChannelOpened(channelType string) {
+	c.mu.RLock()
+	node := c.node
+	c.mu.RUnlock()
+
+	c.stats.mu.Lock()
+	if c.stats.channelsByType == nil {
+		c.stats.channelsByType = make(map[string]int64)
+	}
+	c.stats.channelsByType[channelType]++
+	c.stats.activeChannels++
+	c.stats.lastActivity = time.Now()
+	c.stats.mu.Unlock()
+
+	connChannelsTotal.WithLabelValues(channelType, node).Inc()
+	connChannelsActive.WithLabelValues(channelType).Inc()
+}
+
+// noteChannelClosed records that a channel of channelType was closed.
+func (c *ConnectionContext) noteChannelClosed(channelType string) {
+	c.stats.mu.Lock()
+	c.stats.activeChannels--
+	c.stats.mu.Unlock()
+
+	connChannelsActive.WithLabelValues(channelType).Dec()
+}
+
+// Stats returns a snapshot of this connection's byte and channel counters.
+func (c *ConnectionContext) Stats() ConnStatsSnapshot {
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+
+	byType := make(map[string]int64, len(c.stats.channelsByType))
+	for k, v := range c.stats.channelsByType {
+		byType[k] = v
+	}
+	return ConnStatsSnapshot{
+		BytesRead:      c.stats.bytesRead,
+		BytesWritten:   c.stats.bytesWritten,
+		ChannelsByType: byType,
+		ActiveChannels: c.stats.activeChannels,
+		Opened:         c.stats.opened,
+		LastActivity:   c.stats.lastActivity,
+	}
+}
+
+// StartStatsReporter launches a goroutine that calls emit with a stats
+// snapshot every interval, until ctx is done. Wire emit to audit-log a
+// periodic stats event without lib/sshutils needing to depend on
+// lib/events directly.
+func (c *ConnectionContext) StartStatsReporter(ctx context.Context, interval time.Duration, emit func(ConnStatsSnapshot)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				emit(c.Stats())
+			}
+		}
+	}()
+}
+
+// IdleTimeoutLoop blocks until either ctx is done or timeout has elapsed
+// since the last read/write/channel-open activity on this connection, at
+// which point it closes the connection and returns a connection-problem
+// error. This implements idle-disconnect on the connection itself, rather
+// than per-session, matching what agent-side SSH servers in the ecosystem
+// do for tunneled/multiplexed sessions.
+func (c *ConnectionContext) IdleTimeoutLoop(ctx context.Context, timeout time.Duration) error {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			c.stats.mu.Lock()
+			idle := time.Since(c.stats.lastActivity)
+			c.stats.mu.Unlock()
+			if idle >= timeout {
+				c.Close()
+				if c.NetConn != nil {
+					c.NetConn.Close()
+				}
+				return trace.ConnectionProblem(nil, "connection closed after %v of inactivity", timeout)
+			}
+		}
 	}
 }
 
 // StartAgent sets up a new agent forwarding channel, scoped to the supplied context.
 func (c *ConnectionContext) StartAgent(ctx context.Context) (agent.Agent, error) {
 	// open a channel to the client where the client will serve an agent
-	agentChannel, _, err := c.ServerConn.OpenChannel(AuthAgentRequest, nil)
+	agentChannel, _, err := c.OpenChannel(AuthAgentRequest, nil)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -83,13 +392,137 @@ func (c *ConnectionContext) StartAgent(ctx context.Context) (agent.Agent, error)
 	return agent.NewClient(agentChannel), nil
 }
 
-// SetEnv sets a environment variable within this context.
+// SetEnv sets a environment variable within this context. The well-known
+// SessionTypeEnv key is intercepted to classify the session instead of
+// being exported to the remote shell.
 func (c *ConnectionContext) SetEnv(key, val string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if key == SessionTypeEnv {
+		c.sessionType = val
+		c.sessionTypeExplicit = true
+		return
+	}
 	c.env[key] = val
 }
 
+// NoteSubsystemRequest refines the session type classification from the
+// name of a "subsystem" channel request, unless the session type was
+// already set explicitly via SessionTypeEnv.
+func (c *ConnectionContext) NoteSubsystemRequest(name string) {
+	switch name {
+	case "sftp":
+		c.classify(SessionTypeSFTP)
+	}
+}
+
+// NoteExecCommand refines the session type classification from the
+// command of an "exec" channel request, matching well-known substrings for
+// scp, git, ansible and common IDE server launchers, unless the session
+// type was already set explicitly via SessionTypeEnv.
+func (c *ConnectionContext) NoteExecCommand(command string) {
+	switch {
+	case strings.HasPrefix(command, "scp "), command == "scp":
+		c.classify(SessionTypeSCP)
+	case strings.Contains(command, "git-upload-pack"), strings.Contains(command, "git-receive-pack"):
+		c.classify(SessionTypeGit)
+	case strings.Contains(command, "vscode-server"):
+		c.classify(SessionTypeVSCode)
+	case strings.Contains(command, "jetbrains"), strings.Contains(command, ".jbserver"):
+		c.classify(SessionTypeJetBrains)
+	case strings.Contains(command, "ansible"):
+		c.classify(SessionTypeAnsible)
+	}
+}
+
+// classify sets sessionType to typ unless an explicit SessionTypeEnv value
+// has already been recorded.
+func (c *ConnectionContext) classify(typ string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessionTypeExplicit {
+		return
+	}
+	c.sessionType = typ
+}
+
+// SessionType returns the best-effort classification of this connection's
+// session, defaulting to SessionTypeShell until a subsystem/exec request
+// or SessionTypeEnv narrows it further.
+func (c *ConnectionContext) SessionType() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.sessionType == "" {
+		return SessionTypeShell
+	}
+	return c.sessionType
+}
+
+// SetIdentity records the login and node name this connection is
+// associated with, so RecordSessionStart can label metrics without
+// ConnectionContext needing to know about services.Server or auth
+// identity types directly.
+func (c *ConnectionContext) SetIdentity(login, node string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.login = login
+	c.node = node
+}
+
+// RecordSessionStart increments teleport_ssh_sessions_total and
+// teleport_ssh_sessions_active for this connection's classified type. It
+// is safe to call more than once; until Close, only the first call is
+// counted.
+func (c *ConnectionContext) RecordSessionStart() {
+	c.mu.Lock()
+	if c.metricsRecorded {
+		c.mu.Unlock()
+		return
+	}
+	c.metricsRecorded = true
+	typ := c.sessionType
+	if typ == "" {
+		typ = SessionTypeShell
+	}
+	c.metricsType = typ
+	login, node := c.login, c.node
+	c.mu.Unlock()
+
+	sshSessionsTotal.WithLabelValues(typ, login, node).Inc()
+	sshSessionsActive.WithLabelValues(typ).Inc()
+}
+
+// SetReconnectingSessionRegistry wires this connection to the process-wide
+// registry AdoptReconnectingSession looks sessions up in.
+func (c *ConnectionContext) SetReconnectingSessionRegistry(r *ReconnectingSessionRegistry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconnectRegistry = r
+}
+
+// AdoptReconnectingSession looks up id in this connection's registry and
+// attaches ch to it, replaying its buffered scrollback, so a client that
+// presents a session UUID it created earlier (e.g. after reconnecting
+// following a network blip) can resume it. No ReconnectPTYRequest
+// global-request handler calls it.
+func (c *ConnectionContext) AdoptReconnectingSession(id string, ch ssh.Channel) (*ReconnectingSession, error) {
+	c.mu.RLock()
+	registry := c.reconnectRegistry
+	c.mu.RUnlock()
+
+	if registry == nil {
+		return nil, trace.NotFound("connection has no reconnecting-session registry configured")
+	}
+	session, ok := registry.Get(id)
+	if !ok {
+		return nil, trace.NotFound("no reconnecting session with id %q", id)
+	}
+	if err := session.Attach(ch); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return session, nil
+}
+
 // GetEnv returns a environment variable within this context.
 func (c *ConnectionContext) GetEnv(key string) (string, bool) {
 	c.mu.RLock()
@@ -154,6 +587,13 @@ func (c *ConnectionContext) takeClosers() []io.Closer {
 func (c *ConnectionContext) Close() error {
 	var errs []error
 
+	c.mu.Lock()
+	if c.metricsRecorded {
+		sshSessionsActive.WithLabelValues(c.metricsType).Dec()
+		c.metricsRecorded = false
+	}
+	c.mu.Unlock()
+
 	closers := c.takeClosers()
 
 	for _, cl := range closers {
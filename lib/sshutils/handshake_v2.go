@@ -0,0 +1,149 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sshutils
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/gravitational/trace"
+)
+
+// ProxyHandshakeVersion is the current version of the framed proxy<->server
+// handshake. A server advertising a version below
+// MinFramedHandshakeVersion only understands the legacy single-payload
+// format that the proxy subsystem's doLegacyHandshake writes.
+const ProxyHandshakeVersion = 2
+
+// MinFramedHandshakeVersion is the lowest server-advertised handshake
+// version that understands the framed, capability-negotiating handshake
+// introduced in ProxyHandshakeVersion 2. Servers below this version get the
+// original HandshakePayload-only handshake for backward compatibility.
+const MinFramedHandshakeVersion = 2
+
+// MaxHandshakeFrameBytes bounds the size of a single framed handshake
+// message so a misbehaving peer can't make us allocate unbounded memory.
+const MaxHandshakeFrameBytes = 32 * 1024
+
+// ProxyCapability is a bitmap of optional handshake extensions a peer
+// understands. The server echoes back the subset of the client's requested
+// capabilities that it actually supports.
+type ProxyCapability uint32
+
+const (
+	// CapClientIP indicates support for the forwarded client IP extension
+	// (the direct successor of the original HandshakePayload.ClientAddr).
+	CapClientIP ProxyCapability = 1 << iota
+	// CapPROXYProtocol indicates the server understands PROXY-protocol-v2
+	// style TLS SNI/ALPN TLVs, letting the proxy skip its own IP-forwarding
+	// wrapper.
+	CapPROXYProtocol
+	// CapForwardedIdentity indicates support for a forwarded JWT identity
+	// extension.
+	CapForwardedIdentity
+	// CapResourceLimits indicates support for requested per-connection
+	// resource limits (bandwidth caps, max sessions, etc).
+	CapResourceLimits
+	// CapKeepalive indicates support for negotiated upstream keepalive
+	// parameters.
+	CapKeepalive
+)
+
+// Has returns true if flag is set in the capability bitmap.
+func (c ProxyCapability) Has(flag ProxyCapability) bool {
+	return c&flag != 0
+}
+
+// ProxyHandshakeExtensions carries the typed, optional extensions attached
+// to a framed proxy handshake. Only fields whose corresponding capability
+// bit is set in the frame's Capabilities should be considered populated.
+type ProxyHandshakeExtensions struct {
+	// ClientAddr is the client's real address, replacing
+	// HandshakePayload.ClientAddr in the framed format.
+	ClientAddr string `json:"client_addr,omitempty"`
+	// SNI is the TLS SNI the original client connection presented, if any.
+	SNI string `json:"sni,omitempty"`
+	// ALPN is the TLS ALPN protocol the original client connection
+	// negotiated, if any.
+	ALPN string `json:"alpn,omitempty"`
+	// ForwardedJWT is an identity token forwarded on behalf of the caller.
+	ForwardedJWT string `json:"forwarded_jwt,omitempty"`
+	// MaxBytesPerSecond requests a per-connection bandwidth cap.
+	MaxBytesPerSecond int64 `json:"max_bytes_per_second,omitempty"`
+	// KeepAliveSeconds requests the interval for upstream keepalive probes.
+	KeepAliveSeconds int `json:"keep_alive_seconds,omitempty"`
+}
+
+// ProxyHandshakeFrame is the versioned, extensible message exchanged
+// between a Teleport proxy and an SSH server in place of the single
+// HandshakePayload JSON blob. The proxy sends a frame advertising the
+// capabilities it wants to use; the server replies with a frame whose
+// Capabilities field is narrowed to the subset it actually understands.
+type ProxyHandshakeFrame struct {
+	// Version is the sender's handshake version.
+	Version uint16 `json:"version"`
+	// Capabilities is a bitmap of extensions the sender supports (when
+	// sent by the proxy) or understood (when echoed back by the server).
+	Capabilities ProxyCapability `json:"capabilities"`
+	// Extensions carries the typed extension payloads described above.
+	Extensions ProxyHandshakeExtensions `json:"extensions"`
+}
+
+// WriteFramedHandshake writes a length-prefixed JSON-encoded
+// ProxyHandshakeFrame to w: a 4-byte big-endian length followed by the
+// frame body.
+func WriteFramedHandshake(w io.Writer, frame ProxyHandshakeFrame) error {
+	body, err := json.Marshal(frame)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if len(body) > MaxHandshakeFrameBytes {
+		return trace.BadParameter("handshake frame too large: %v bytes", len(body))
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(body)))
+	if _, err := w.Write(header); err != nil {
+		return trace.Wrap(err)
+	}
+	if _, err := w.Write(body); err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// ReadFramedHandshake reads a length-prefixed JSON-encoded
+// ProxyHandshakeFrame written by WriteFramedHandshake.
+func ReadFramedHandshake(r io.Reader) (*ProxyHandshakeFrame, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > MaxHandshakeFrameBytes {
+		return nil, trace.BadParameter("handshake frame too large: %v bytes", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var frame ProxyHandshakeFrame
+	if err := json.Unmarshal(body, &frame); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &frame, nil
+}
@@ -0,0 +1,378 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sshutils
+
+import (
+	"encoding/json"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/trace"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ReconnectPTYRequest is the SSH global request type a client sends to
+// resume a reconnecting-PTY session after a network blip, carrying a
+// reconnectPTYRequest payload.
+const ReconnectPTYRequest = "teleport-reconnect@goteleport.com"
+
+const (
+	// defaultScrollbackSize is used when NewReconnectingSession is given a
+	// non-positive scrollback size.
+	defaultScrollbackSize = 1024 * 1024 // 1 MiB
+
+	// defaultSessionTTL is used when NewReconnectingSessionRegistry is
+	// given a non-positive TTL.
+	defaultSessionTTL = 30 * time.Minute
+)
+
+// reconnectPTYRequest is the JSON payload of a ReconnectPTYRequest global
+// request.
+type reconnectPTYRequest struct {
+	ID     string `json:"id"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// ParseReconnectPTYRequest unmarshals a ReconnectPTYRequest global
+// request's payload.
+func ParseReconnectPTYRequest(payload []byte) (id string, width, height int, err error) {
+	var req reconnectPTYRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return "", 0, 0, trace.Wrap(err)
+	}
+	if req.ID == "" {
+		return "", 0, 0, trace.BadParameter("missing reconnecting session id")
+	}
+	return req.ID, req.Width, req.Height, nil
+}
+
+// PTY is the minimal surface ReconnectingSession needs from a real
+// pseudo-terminal. It's kept abstract so sshutils doesn't have to take a
+// dependency on whatever PTY library the server uses to actually open one.
+type PTY interface {
+	io.ReadWriteCloser
+	// Resize changes the terminal's window size.
+	Resize(width, height int) error
+}
+
+var (
+	reconnectSessionsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "teleport_reconnecting_sessions_active",
+		Help: "Number of reconnecting-PTY sessions currently held open",
+	})
+	reconnectSessionsExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "teleport_reconnecting_sessions_expired_total",
+		Help: "Number of reconnecting-PTY sessions closed for exceeding their idle TTL",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(reconnectSessionsActive)
+	prometheus.MustRegister(reconnectSessionsExpired)
+}
+
+// scrollback is a fixed-capacity ring buffer of the most recent bytes
+// written to a reconnecting session's PTY, replayed to a newly attached
+// channel so it can repaint the screen instead of starting blank.
+type scrollback struct {
+	mu   sync.Mutex
+	buf  []byte
+	pos  int
+	full bool
+}
+
+func newScrollback(size int) *scrollback {
+	return &scrollback{buf: make([]byte, size)}
+}
+
+// Write appends p to the ring buffer, overwriting the oldest bytes once
+// it's full.
+func (s *scrollback) Write(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range p {
+		s.buf[s.pos] = b
+		s.pos++
+		if s.pos == len(s.buf) {
+			s.pos = 0
+			s.full = true
+		}
+	}
+}
+
+// Snapshot copies out the buffered bytes in chronological order. It must
+// copy under lock rather than return a slice into buf, so replay to a
+// newly attached channel never races with the read loop's concurrent
+// writes.
+func (s *scrollback) Snapshot() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.full {
+		out := make([]byte, s.pos)
+		copy(out, s.buf[:s.pos])
+		return out
+	}
+	out := make([]byte, len(s.buf))
+	n := copy(out, s.buf[s.pos:])
+	copy(out[n:], s.buf[:s.pos])
+	return out
+}
+
+// ReconnectingSession is a PTY-backed child process that outlives any
+// single SSH channel, keyed by a client-supplied UUID so a client whose
+// TCP connection dropped can resume the same shell instead of losing it.
+type ReconnectingSession struct {
+	// ID is the UUID the client supplied when it first created this
+	// session, and must present again via ReconnectPTYRequest to resume it.
+	ID string
+
+	pty        PTY
+	cmd        *exec.Cmd
+	scrollback *scrollback
+
+	mu           sync.Mutex
+	channel      ssh.Channel
+	lastActivity time.Time
+	closed       bool
+}
+
+// NewReconnectingSession creates a session around an already-started pty
+// and child process, and starts the single goroutine that drains the PTY
+// for the lifetime of the session. scrollbackSize <= 0 uses
+// defaultScrollbackSize.
+func NewReconnectingSession(id string, pty PTY, cmd *exec.Cmd, scrollbackSize int) *ReconnectingSession {
+	if scrollbackSize <= 0 {
+		scrollbackSize = defaultScrollbackSize
+	}
+	s := &ReconnectingSession{
+		ID:           id,
+		pty:          pty,
+		cmd:          cmd,
+		scrollback:   newScrollback(scrollbackSize),
+		lastActivity: time.Now(),
+	}
+	go s.readLoop()
+	return s
+}
+
+// readLoop is the only goroutine that ever reads from the PTY, so a
+// reconnect never races two readers over the same output. Every chunk is
+// appended to the scrollback buffer and, if a channel is currently
+// attached, forwarded to it directly; there is no fan-out broadcast
+// channel because at most one channel is ever attached at a time.
+//
+// The append and the channel read happen in the same s.mu critical section
+// as Attach's snapshot-and-swap, so each chunk reaches a newly attached
+// channel exactly once: a chunk appended before the snapshot is in the
+// replay (while it still fits in the scrollback) and is forwarded live only
+// to the channel attached before it, and a chunk appended after the swap is
+// forwarded live to the new channel and is not in the replay.
+func (s *ReconnectingSession) readLoop() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := s.pty.Read(buf)
+		if n > 0 {
+			chunk := buf[:n]
+
+			s.mu.Lock()
+			s.scrollback.Write(chunk)
+			ch := s.channel
+			s.lastActivity = time.Now()
+			s.mu.Unlock()
+
+			if ch != nil {
+				if _, werr := ch.Write(chunk); werr != nil {
+					s.Detach(ch)
+				}
+			}
+		}
+		if err != nil {
+			s.Close()
+			return
+		}
+	}
+}
+
+// Attach detaches any previously attached channel, replays the buffered
+// scrollback to ch, and makes ch the new target of the PTY's output. The
+// scrollback snapshot and the channel swap happen in the same s.mu critical
+// section as readLoop's append-and-forward, so the replay holds exactly the
+// chunks appended before the swap (up to the scrollback size) -- see
+// readLoop's comment for why each chunk then reaches ch exactly once.
+func (s *ReconnectingSession) Attach(ch ssh.Channel) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return trace.NotFound("reconnecting session %q has already closed", s.ID)
+	}
+	replay := s.scrollback.Snapshot()
+	old := s.channel
+	s.channel = ch
+	s.lastActivity = time.Now()
+	s.mu.Unlock()
+
+	if old != nil && old != ch {
+		old.Close()
+	}
+
+	if len(replay) > 0 {
+		if _, err := ch.Write(replay); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// Detach clears the attached channel if it is still ch, so a write
+// failure on a now-dead channel doesn't keep targeting it.
+func (s *ReconnectingSession) Detach(ch ssh.Channel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.channel == ch {
+		s.channel = nil
+	}
+}
+
+// WriteInput forwards client keystrokes to the PTY.
+func (s *ReconnectingSession) WriteInput(p []byte) (int, error) {
+	return s.pty.Write(p)
+}
+
+// Resize changes the PTY's window size in response to an SSH
+// window-change request on the attached channel.
+func (s *ReconnectingSession) Resize(width, height int) error {
+	s.mu.Lock()
+	s.lastActivity = time.Now()
+	s.mu.Unlock()
+	return trace.Wrap(s.pty.Resize(width, height))
+}
+
+// Idle returns how long it has been since this session last saw PTY
+// output, a channel attach, or a resize.
+func (s *ReconnectingSession) Idle(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.Sub(s.lastActivity)
+}
+
+// Close detaches any attached channel and terminates the underlying PTY
+// and child process. Safe to call more than once.
+func (s *ReconnectingSession) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	ch := s.channel
+	s.channel = nil
+	s.mu.Unlock()
+
+	if ch != nil {
+		ch.Close()
+	}
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	}
+	return trace.Wrap(s.pty.Close())
+}
+
+// ReconnectingSessionRegistry tracks every live ReconnectingSession for a
+// process, so any ConnectionContext can adopt one by ID regardless of
+// which connection originally created it.
+type ReconnectingSessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*ReconnectingSession
+	ttl      time.Duration
+}
+
+// NewReconnectingSessionRegistry returns a registry that expires sessions
+// idle for longer than ttl. ttl <= 0 uses defaultSessionTTL.
+func NewReconnectingSessionRegistry(ttl time.Duration) *ReconnectingSessionRegistry {
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	r := &ReconnectingSessionRegistry{
+		sessions: make(map[string]*ReconnectingSession),
+		ttl:      ttl,
+	}
+	go r.expireLoop()
+	return r
+}
+
+// Register adds a newly created session to the registry.
+func (r *ReconnectingSessionRegistry) Register(s *ReconnectingSession) {
+	r.mu.Lock()
+	r.sessions[s.ID] = s
+	r.mu.Unlock()
+	reconnectSessionsActive.Inc()
+}
+
+// Get looks up a session by the UUID the client presented.
+func (r *ReconnectingSessionRegistry) Get(id string) (*ReconnectingSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// Remove drops a session from the registry, e.g. once the caller has
+// explicitly closed it.
+func (r *ReconnectingSessionRegistry) Remove(id string) {
+	r.mu.Lock()
+	_, ok := r.sessions[id]
+	delete(r.sessions, id)
+	r.mu.Unlock()
+	if ok {
+		reconnectSessionsActive.Dec()
+	}
+}
+
+// expireLoop periodically sweeps for and closes sessions that have been
+// idle longer than r.ttl.
+func (r *ReconnectingSessionRegistry) expireLoop() {
+	ticker := time.NewTicker(r.ttl / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.expireIdle()
+	}
+}
+
+func (r *ReconnectingSessionRegistry) expireIdle() {
+	now := time.Now()
+
+	r.mu.Lock()
+	var expired []*ReconnectingSession
+	for id, s := range r.sessions {
+		if s.Idle(now) > r.ttl {
+			expired = append(expired, s)
+			delete(r.sessions, id)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, s := range expired {
+		s.Close()
+		reconnectSessionsActive.Dec()
+		reconnectSessionsExpired.Inc()
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2020 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sshutils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/trace"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SpeedtestChannelRequest is the SSH channel type used for the in-band
+// throughput diagnostic, opened over the same authenticated connection as
+// any other channel so no new listener is required.
+const SpeedtestChannelRequest = "teleport-speedtest@goteleport.com"
+
+// SpeedtestVerb is the RBAC verb for running a speedtest against the
+// ssh_server resource. RunSpeedtest does not check it, and nothing in this
+// package enforces it.
+const SpeedtestVerb = "speedtest"
+
+// Speedtest direction values accepted by ParseSpeedtestRequest.
+const (
+	SpeedtestUpload   = "upload"
+	SpeedtestDownload = "download"
+	SpeedtestBoth     = "both"
+)
+
+// speedtestSampleInterval is how often RunSpeedtest reports a throughput
+// sample while a test is in progress.
+const speedtestSampleInterval = time.Second
+
+// defaultSpeedtestDuration and defaultSpeedtestBlockSize are used when
+// ParseSpeedtestRequest sees a non-positive value for either field.
+const (
+	defaultSpeedtestDuration  = 10 * time.Second
+	defaultSpeedtestBlockSize = 32 * 1024
+)
+
+// speedtestRequest is the JSON payload of a SpeedtestChannelRequest.
+type speedtestRequest struct {
+	Direction string        `json:"direction"`
+	Duration  time.Duration `json:"duration"`
+	BlockSize int           `json:"block_size"`
+}
+
+// ParseSpeedtestRequest unmarshals a SpeedtestChannelRequest payload,
+// filling in default duration/block size where the client left them unset.
+func ParseSpeedtestRequest(payload []byte) (direction string, duration time.Duration, blockSize int, err error) {
+	var req speedtestRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return "", 0, 0, trace.Wrap(err)
+	}
+	switch req.Direction {
+	case SpeedtestUpload, SpeedtestDownload, SpeedtestBoth:
+	default:
+		return "", 0, 0, trace.BadParameter("invalid speedtest direction %q", req.Direction)
+	}
+	duration = req.Duration
+	if duration <= 0 {
+		duration = defaultSpeedtestDuration
+	}
+	blockSize = req.BlockSize
+	if blockSize <= 0 {
+		blockSize = defaultSpeedtestBlockSize
+	}
+	return req.Direction, duration, blockSize, nil
+}
+
+// SpeedtestSample is one interval's throughput measurement.
+type SpeedtestSample struct {
+	Interval time.Duration
+	Bytes    int64
+	Mbps     float64
+}
+
+// SpeedtestResult is returned to the client once a speedtest completes.
+type SpeedtestResult struct {
+	Direction     string
+	Samples       []SpeedtestSample
+	AggregateMbps float64
+}
+
+var speedtestMbps = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "teleport_ssh_speedtest_mbps",
+	Help: "Throughput measured by the most recent SSH speedtest against a node, in Mbps",
+}, []string{"node", "direction"})
+
+func init() {
+	prometheus.MustRegister(speedtestMbps)
+}
+
+// RunSpeedtest drives an in-band throughput test over ch: for
+// SpeedtestUpload/Both it reads and discards bytes the client sends; for
+// SpeedtestDownload/Both it writes a fixed-size buffer of random bytes,
+// reused on every write, for duration. It samples bytes transferred every
+// speedtestSampleInterval and returns per-interval throughput plus the
+// aggregate. Canceling ctx tears down the generator/sink goroutines
+// immediately, so an aborted client doesn't leak them.
+func (c *ConnectionContext) RunSpeedtest(ctx context.Context, ch ssh.Channel, direction string, duration time.Duration, blockSize int) (*SpeedtestResult, error) {
+	if blockSize <= 0 {
+		blockSize = defaultSpeedtestBlockSize
+	}
+	if duration <= 0 {
+		duration = defaultSpeedtestDuration
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	// ssh.Channel has no read deadline, so a blocked ch.Read wouldn't
+	// otherwise notice runCtx expiring or being canceled. Closing ch once
+	// runCtx is done unblocks it (and any in-flight ch.Write) immediately;
+	// by this point RunSpeedtest is finished with the channel regardless of
+	// whether it ran to completion or was aborted.
+	go func() {
+		<-runCtx.Done()
+		ch.Close()
+	}()
+
+	var transferred int64
+	var wg sync.WaitGroup
+	errCh := make(chan error, 2)
+
+	if direction == SpeedtestDownload || direction == SpeedtestBoth {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, blockSize)
+			rand.Read(buf)
+			for {
+				select {
+				case <-runCtx.Done():
+					return
+				default:
+				}
+				n, err := ch.Write(buf)
+				if n > 0 {
+					atomic.AddInt64(&transferred, int64(n))
+				}
+				if err != nil {
+					select {
+					case errCh <- err:
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	if direction == SpeedtestUpload || direction == SpeedtestBoth {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, blockSize)
+			for {
+				select {
+				case <-runCtx.Done():
+					return
+				default:
+				}
+				n, err := ch.Read(buf)
+				if n > 0 {
+					atomic.AddInt64(&transferred, int64(n))
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	var samples []SpeedtestSample
+	var last int64
+	ticker := time.NewTicker(speedtestSampleInterval)
+	defer ticker.Stop()
+
+sampleLoop:
+	for {
+		select {
+		case <-runCtx.Done():
+			break sampleLoop
+		case <-ticker.C:
+			cur := atomic.LoadInt64(&transferred)
+			delta := cur - last
+			last = cur
+			samples = append(samples, SpeedtestSample{
+				Interval: speedtestSampleInterval,
+				Bytes:    delta,
+				Mbps:     speedtestMbpsOf(delta, speedtestSampleInterval),
+			})
+		}
+	}
+
+	wg.Wait()
+
+	total := atomic.LoadInt64(&transferred)
+	result := &SpeedtestResult{
+		Direction:     direction,
+		Samples:       samples,
+		AggregateMbps: speedtestMbpsOf(total, duration),
+	}
+
+	c.mu.RLock()
+	node := c.node
+	c.mu.RUnlock()
+	speedtestMbps.WithLabelValues(node, direction).Set(result.AggregateMbps)
+
+	select {
+	case err := <-errCh:
+		return result, trace.Wrap(err)
+	default:
+	}
+	return result, nil
+}
+
+// speedtestMbpsOf converts a byte count transferred over d into Mbps.
+func speedtestMbpsOf(bytes int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / d.Seconds() / 1e6
+}